@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Camera is what the downloader needs from a dashcam: reachability, the media
+// listings and where to fetch each file from.
+type Camera interface {
+	connect() bool
+	hasSession() bool
+	getEvents() (error, FileList)
+	getRecordings() (error, FileList)
+	getGpsFiles() (error, FileList)
+	deleteEvent(event File) error
+	fileURL(name string) string
+	baseURL() string
+}
+
+// Camera command used to delete an event (video and thumbnail)
+const eventDeleteCmd = "APP_EventDelReq"
+
+type EventList struct {
+	Num   int `json:"num"`
+	Event []struct {
+		Index      string `json:"index"`
+		Imgname    string `json:"imgname"`
+		Bvideoname string `json:"bvideoname"`
+		Bstarttime string `json:"bstarttime"`
+		Bendtime   string `json:"bendtime"`
+		Bvideosize string `json:"bvideosize"`
+	} `json:"event"`
+}
+
+type PlaybackList struct {
+	Num  int `json:"num"`
+	File []struct {
+		Index     string `json:"index"`
+		Starttime string `json:"starttime"`
+		Endtime   string `json:"endtime"`
+		Name      string `json:"name"`
+		Size      int    `json:"size,omitempty"`
+	} `json:"file"`
+}
+
+type GpsFileList struct {
+	Num  int `json:"num"`
+	File []struct {
+		Index      string `json:"index"`
+		Type       string `json:"type"`
+		Starttime  string `json:"starttime"`
+		Endtime    string `json:"endtime"`
+		Name       string `json:"name"`
+		Parentfile string `json:"parentfile"`
+	} `json:"file"`
+}
+
+type Session struct {
+	AcSessionID string `json:"acSessionId"`
+}
+
+type JsonHeader struct {
+	Errcode int    `json:"errcode"`
+	Data    string `json:"data"`
+}
+
+type DdpaiCamera struct {
+	camPath      string
+	session      Session
+	eventList    EventList
+	playbackList PlaybackList
+	gpsFileList  GpsFileList
+	httpClient   http.Client
+}
+
+func makeCamera(camPath string, timeout time.Duration) *DdpaiCamera {
+	return &DdpaiCamera{
+		camPath:    camPath,
+		httpClient: http.Client{Timeout: timeout},
+	}
+}
+
+func (c *DdpaiCamera) connect() bool {
+	resp, err := c.httpClient.Get(c.camPath)
+	if err != nil {
+		c.reset()
+		return false
+	} else {
+		resp.Body.Close()
+		if c.session.AcSessionID == "" {
+			c.auth()
+			c.requestCert()
+		}
+		return true
+	}
+}
+
+// hasSession tells whether the camera handed out a session ID since it was last reachable
+func (c *DdpaiCamera) hasSession() bool {
+	return c.session.AcSessionID != ""
+}
+
+func (c *DdpaiCamera) reset() {
+	c.session.AcSessionID = ""
+}
+
+func (c *DdpaiCamera) getRecordings() (error, FileList) {
+	var list FileList
+	err := c.getJson(c.camPath+"/vcam/cmd.cgi?cmd=APP_PlaybackListReq", &c.playbackList)
+	if err != nil {
+		c.reset()
+		return err, list
+	}
+
+	// Get timelapse and continuous recordings
+	for i := range c.playbackList.File {
+		rec := c.playbackList.File[len(c.playbackList.File)-i-1]
+		if rec.Name == "" {
+			log.Warn("Skipping recording entry with no filename, index: ", rec.Index)
+			continue
+		}
+		if rec.Size <= 0 {
+			log.Debug("Skipping recording still being written (size 0): ", rec.Name)
+			continue
+		}
+		date, err := fileNameToDate(rec.Name)
+		if err != nil {
+			log.Warn("Skipping recording with unparseable filename: ", rec.Name, " error: ", err)
+			continue
+		}
+		// Download
+		list = append(list, File{
+			kind: kindRecording,
+			name: rec.Name,
+			url:  c.fileURL(rec.Name),
+			date: date,
+			size: int64(rec.Size),
+		})
+	}
+	return nil, list
+}
+
+func (c *DdpaiCamera) getEvents() (error, FileList) {
+	var list FileList
+	err := c.getJson(c.camPath+"/vcam/cmd.cgi?cmd=APP_EventListReq", &c.eventList)
+	if err != nil {
+		c.reset()
+		return err, list
+	}
+
+	// Get Event files
+	for _, event := range c.eventList.Event {
+		// Skip malformed entries with no video file (e.g. corrupt/incomplete camera events)
+		if event.Bvideoname == "" {
+			log.Warn("Skipping malformed event entry with no video file, index: ", event.Index)
+			continue
+		}
+		if event.Bvideosize == "" || event.Bvideosize == "0" {
+			log.Debug("Skipping event still being written (no size): ", event.Bvideoname)
+			continue
+		}
+		// Still downloaded without a size, but never deleted from the camera
+		size, err := strconv.ParseInt(event.Bvideosize, 10, 64)
+		if err != nil {
+			log.Warn("Event with unparseable size, keeping it on the camera: ", event.Bvideoname, " size: ", event.Bvideosize)
+			size = 0
+		}
+		date, err := fileNameToDate(event.Bvideoname)
+		if err != nil {
+			// Skip entries where the filename can't be parsed instead of stopping everything
+			log.Warn("Skipping event with unparseable filename: ", event.Bvideoname, " error: ", err)
+			continue
+		}
+		// Start and end are optional; the file name time is used without them
+		start, err := parseCameraTime(event.Bstarttime)
+		if err != nil {
+			log.Debug("Ignoring start time of event ", event.Bvideoname, ": ", err)
+		}
+		end, err := parseCameraTime(event.Bendtime)
+		if err != nil {
+			log.Debug("Ignoring end time of event ", event.Bvideoname, ": ", err)
+		}
+		list = append(list, File{
+			kind:      kindEvent,
+			name:      event.Bvideoname,
+			url:       c.fileURL(event.Bvideoname),
+			date:      date,
+			size:      size,
+			index:     event.Index,
+			thumbnail: event.Imgname,
+			start:     start,
+			end:       end,
+		})
+		// Only add thumbnail if it exists
+		if event.Imgname != "" {
+			list = append(list, File{
+				kind: kindThumbnail,
+				name: event.Imgname,
+				url:  c.fileURL(event.Imgname),
+				date: date,
+			})
+		}
+	}
+	return nil, list
+}
+
+func (c *DdpaiCamera) getGpsFiles() (error, FileList) {
+	var list FileList
+	err := c.getJson(c.camPath+"/vcam/cmd.cgi?cmd=API_GpsFileListReq", &c.gpsFileList)
+	if err != nil {
+		c.reset()
+		return err, list
+	}
+
+	// Get GPS files
+	for _, gpsF := range c.gpsFileList.File {
+		if gpsF.Name == "" {
+			log.Warn("Skipping GPS file entry with no filename, index: ", gpsF.Index)
+			continue
+		}
+		date, err := fileNameToDate(gpsF.Name)
+		if err != nil {
+			log.Warn("Skipping GPS file with unparseable filename: ", gpsF.Name, " error: ", err)
+			continue
+		}
+		list = append(list, File{
+			kind:   kindGPS,
+			name:   gpsF.Name,
+			url:    c.fileURL(gpsF.Name),
+			date:   date,
+			parent: gpsF.Parentfile,
+		})
+	}
+	return nil, list
+}
+
+// Address the camera was built with
+func (c DdpaiCamera) baseURL() string {
+	return c.camPath
+}
+
+// Location of a media file on the camera
+func (c DdpaiCamera) fileURL(name string) string {
+	return c.camPath + "/" + name
+}
+
+// Get the json output from the API call
+func (c DdpaiCamera) getJson(url string, target interface{}) error {
+
+	req, _ := http.NewRequest("GET", url, nil)
+	if c.session.AcSessionID != "" {
+		req.Header.Set("sessionid", c.session.AcSessionID)
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// Remove the header
+	var jsonDump JsonHeader
+	err = json.NewDecoder(resp.Body).Decode(&jsonDump)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal([]byte(jsonDump.Data), &target)
+}
+
+// Ask the camera to delete an event video along with its thumbnail
+func (c DdpaiCamera) deleteEvent(event File) error {
+	body, err := json.Marshal(map[string]string{
+		"index":      event.index,
+		"bvideoname": event.name,
+		"imgname":    event.thumbnail,
+	})
+	if err != nil {
+		return err
+	}
+	request, _ := http.NewRequest("POST", c.camPath+"/vcam/cmd.cgi?cmd="+eventDeleteCmd, bytes.NewBuffer(body))
+	request.Header.Set("Cookie", "SessionID="+c.session.AcSessionID)
+	request.Header.Set("sessionid", c.session.AcSessionID)
+	request.Header.Set("Content-Type", "application/json")
+	response, err := c.httpClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	var result JsonHeader
+	if err := json.NewDecoder(response.Body).Decode(&result); err != nil {
+		return err
+	}
+	if result.Errcode != 0 {
+		return fmt.Errorf("camera returned errcode %d", result.Errcode)
+	}
+	return nil
+}
+
+func (c *DdpaiCamera) auth() {
+	err := c.getJson(c.camPath+"/vcam/cmd.cgi?cmd=API_RequestSessionID", &c.session)
+	if err == nil && c.session.AcSessionID == "" {
+		err = fmt.Errorf("camera returned no session id")
+	}
+	if err != nil {
+		cameraAuthFailures.Inc()
+		log.Warn("Cannot get a session from the camera: ", err)
+	}
+}
+
+func fileNameToDate(fileName string) (stamp time.Time, err error) {
+	if fileName == "" {
+		return time.Time{}, fmt.Errorf("invalid filename format: %q", fileName)
+	}
+	split := strings.Split(fileName, "_")
+	var datePart string
+	if len(split) == 4 {
+		datePart = split[1]
+	} else {
+		datePart = split[0]
+	}
+	if datePart == "" || len(datePart) != 14 {
+		return time.Time{}, fmt.Errorf("invalid filename format: %q", fileName)
+	}
+	date, err := time.ParseInLocation("20060102150405", datePart, cameraTZ)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid filename format: %q", fileName)
+	}
+	return date, nil
+}
+
+// parseCameraTime reads the event start/end times, either camera local time
+// (20060102150405) or unix seconds. Empty values give a zero time.
+func parseCameraTime(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if value == "" || value == "0" {
+		return time.Time{}, nil
+	}
+	if len(value) == 14 {
+		if stamp, err := time.ParseInLocation("20060102150405", value, cameraTZ); err == nil {
+			return stamp, nil
+		}
+	}
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid camera time: %q", value)
+	}
+	return time.Unix(seconds, 0), nil
+}
+
+func (c DdpaiCamera) requestCert() error {
+
+	var jsonData = []byte(`{
+		"user": "admin",
+		"password": "admin",
+		"level": 0,
+		"uid": "f2cf6a332999fbc3"}`)
+	request, _ := http.NewRequest("POST", c.camPath+"/vcam/cmd.cgi?cmd=API_RequestCertificate", bytes.NewBuffer(jsonData))
+	request.Header.Set("Cookie", "SessionID="+c.session.AcSessionID)
+	request.Header.Set("sessionid", c.session.AcSessionID)
+	request.Header.Set("Content-Type", "application/json")
+	response, err := c.httpClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	return nil
+}
@@ -0,0 +1,421 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Bucket holding one JSON fileRecord per camera file name
+var filesBucket = []byte("files")
+
+// Number of failures kept per file
+const maxFailureHistory = 10
+
+// Validation status of a downloaded file
+const (
+	validationValid   = "valid"
+	validationInvalid = "invalid"
+)
+
+// fileRecord is everything we know about a camera file
+type fileRecord struct {
+	Name            string            `json:"name"`
+	Kind            fileKind          `json:"kind"`
+	CameraTime      time.Time         `json:"cameraTime"`
+	Size            int64             `json:"size"`
+	DownloadedAt    time.Time         `json:"downloadedAt,omitempty"` // Stitched videos and timelapses: when they were made
+	Path            string            `json:"path,omitempty"`
+	Validation      string            `json:"validation,omitempty"`
+	ValidationError string            `json:"validationError,omitempty"`
+	ValidatedAt     time.Time         `json:"validatedAt,omitempty"`
+	Duration        float64           `json:"duration,omitempty"` // Seconds, for MP4 clips
+	Failures        []downloadFailure `json:"failures,omitempty"`
+	SkippedAt       time.Time         `json:"skippedAt,omitempty"` // Last time it was put in the skip cache
+	EvictedAt       time.Time         `json:"evictedAt,omitempty"` // Deleted locally before its retention ended: storage quota, condensed into a timelapse or over the API
+	Pinned          bool              `json:"pinned,omitempty"`    // Never removed by retention
+	PinReason       string            `json:"pinReason,omitempty"`
+	PinnedAt        time.Time         `json:"pinnedAt,omitempty"`
+	EventStart      time.Time         `json:"eventStart,omitempty"`     // Event videos: Bstarttime
+	EventEnd        time.Time         `json:"eventEnd,omitempty"`       // Event videos: Bendtime
+	Context         []string          `json:"context,omitempty"`        // Event videos: recordings and GPS files around it
+	Events          []string          `json:"events,omitempty"`         // Recordings and GPS files: events they are context for
+	Parent          string            `json:"parent,omitempty"`         // GPS files: the recording they belong to
+	Timelapse       string            `json:"timelapse,omitempty"`      // Parking recordings: the timelapse they were condensed into
+	Thumbnail       string            `json:"thumbnail,omitempty"`      // Recordings: frame grabbed from the middle
+	SubtitlesMuxed  bool              `json:"subtitlesMuxed,omitempty"` // Recordings: the GPS subtitles were added to the MP4
+}
+
+type downloadFailure struct {
+	At    time.Time `json:"at"`
+	Error string    `json:"error"`
+}
+
+// downloaded tells whether we ever had the file, even if it was evicted since
+func (r fileRecord) downloaded() bool {
+	return !r.DownloadedAt.IsZero()
+}
+
+// stored tells whether the file is on disk
+func (r fileRecord) stored() bool {
+	return r.downloaded() && r.EvictedAt.IsZero() && r.Path != ""
+}
+
+// storedSize is what the record adds to the storage used
+func (r fileRecord) storedSize() int64 {
+	if r.stored() {
+		return r.Size
+	}
+	return 0
+}
+
+// catalog is the on-disk record of every file we downloaded or failed to download
+type catalog struct {
+	db          *bolt.DB
+	storedBytes atomic.Int64 // Size of the stored files, kept up to date by update and remove
+}
+
+func openCatalog(path string) (*catalog, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(filesBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(tripsBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	c := &catalog{db: db}
+	var used int64
+	for _, record := range c.list() {
+		used += record.storedSize()
+	}
+	c.storedBytes.Store(used)
+	return c, nil
+}
+
+// openCatalogReadOnly opens an existing catalog without creating or changing anything.
+// Fails with bolt.ErrTimeout while a downloader has the catalog open.
+func openCatalogReadOnly(path string, timeout time.Duration) (*catalog, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{ReadOnly: true, Timeout: timeout})
+	if err != nil {
+		return nil, err
+	}
+	return &catalog{db: db}, nil
+}
+
+func (c *catalog) close() error {
+	return c.db.Close()
+}
+
+func (c *catalog) get(name string) (record fileRecord, found bool) {
+	err := c.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(filesBucket).Get([]byte(name))
+		if data == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(data, &record)
+	})
+	if err != nil {
+		log.Warn("Cannot read catalog entry ", name, ": ", err)
+		return record, false
+	}
+	return record, found
+}
+
+// update applies fn to the record of name, creating it if needed
+func (c *catalog) update(name string, fn func(*fileRecord)) error {
+	var delta int64
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(filesBucket)
+		record := fileRecord{Name: name}
+		if data := bucket.Get([]byte(name)); data != nil {
+			if err := json.Unmarshal(data, &record); err != nil {
+				return err
+			}
+		}
+		delta = -record.storedSize()
+		fn(&record)
+		delta += record.storedSize()
+		data, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(name), data)
+	})
+	if err == nil {
+		c.storedBytes.Add(delta)
+	}
+	return err
+}
+
+func (c *catalog) remove(name string) error {
+	var delta int64
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(filesBucket)
+		if data := bucket.Get([]byte(name)); data != nil {
+			var record fileRecord
+			if json.Unmarshal(data, &record) == nil {
+				delta = -record.storedSize()
+			}
+		}
+		return bucket.Delete([]byte(name))
+	})
+	if err == nil {
+		c.storedBytes.Add(delta)
+	}
+	return err
+}
+
+// usedBytes returns the size of the stored files without reading the catalog
+func (c *catalog) usedBytes() int64 {
+	return c.storedBytes.Load()
+}
+
+// list returns every record, oldest camera time first
+func (c *catalog) list() (records []fileRecord) {
+	err := c.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(filesBucket).ForEach(func(k, v []byte) error {
+			var record fileRecord
+			if err := json.Unmarshal(v, &record); err != nil {
+				log.Warn("Skipping unreadable catalog entry ", string(k), ": ", err)
+				return nil
+			}
+			records = append(records, record)
+			return nil
+		})
+	})
+	if err != nil {
+		log.Warn("Cannot read catalog: ", err)
+	}
+	sort.SliceStable(records, func(i, j int) bool { return records[i].CameraTime.Before(records[j].CameraTime) })
+	return records
+}
+
+// listBetween returns the camera files whose name time is within [from, to], oldest
+// first. Only the records in range are decoded; files made here are left out.
+func (c *catalog) listBetween(from time.Time, to time.Time) (records []fileRecord) {
+	err := c.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(filesBucket).ForEach(func(k, v []byte) error {
+			date, err := fileNameToDate(string(k))
+			if err != nil || date.Before(from) || date.After(to) {
+				return nil
+			}
+			var record fileRecord
+			if err := json.Unmarshal(v, &record); err != nil {
+				log.Warn("Skipping unreadable catalog entry ", string(k), ": ", err)
+				return nil
+			}
+			records = append(records, record)
+			return nil
+		})
+	})
+	if err != nil {
+		log.Warn("Cannot read catalog: ", err)
+	}
+	sort.SliceStable(records, func(i, j int) bool { return records[i].CameraTime.Before(records[j].CameraTime) })
+	return records
+}
+
+func (c *catalog) count() (n int) {
+	c.db.View(func(tx *bolt.Tx) error {
+		n = tx.Bucket(filesBucket).Stats().KeyN
+		return nil
+	})
+	return n
+}
+
+// recordDownload stores a successfully downloaded file
+func (c *catalog) recordDownload(file File, path string) {
+	var size int64
+	if info, err := os.Stat(path); err == nil {
+		size = info.Size()
+	}
+	err := c.update(file.name, func(r *fileRecord) {
+		r.Kind = file.kind
+		r.CameraTime = file.date
+		r.Size = size
+		r.DownloadedAt = time.Now()
+		r.Path = path
+		r.SkippedAt = time.Time{}
+		r.EvictedAt = time.Time{}
+		r.EventStart = file.start
+		r.EventEnd = file.end
+		r.Parent = file.parent
+	})
+	if err != nil {
+		log.Warn("Cannot record download of ", file.name, ": ", err)
+		return
+	}
+	if record, found := c.get(file.name); found {
+		autoPin(record)
+	}
+}
+
+// recordFailure adds to the failure history of a file; skipped marks it for the skip cache
+func (c *catalog) recordFailure(file File, failure error, skipped bool) {
+	err := c.update(file.name, func(r *fileRecord) {
+		r.Kind = file.kind
+		r.CameraTime = file.date
+		r.Failures = append(r.Failures, downloadFailure{At: time.Now(), Error: failure.Error()})
+		if len(r.Failures) > maxFailureHistory {
+			r.Failures = r.Failures[len(r.Failures)-maxFailureHistory:]
+		}
+		if skipped {
+			r.SkippedAt = time.Now()
+		}
+	})
+	if err != nil {
+		log.Warn("Cannot record failure of ", file.name, ": ", err)
+	}
+}
+
+// recordValidation stores the outcome of an MP4 check
+func (c *catalog) recordValidation(name string, duration time.Duration, failure error) {
+	err := c.update(name, func(r *fileRecord) {
+		r.Validation = validationValid
+		r.ValidationError = ""
+		if failure != nil {
+			r.Validation = validationInvalid
+			r.ValidationError = failure.Error()
+		}
+		r.ValidatedAt = time.Now()
+		r.Duration = duration.Seconds()
+	})
+	if err != nil {
+		log.Warn("Cannot record validation of ", name, ": ", err)
+	}
+}
+
+// loadSkipCache restores the skip cache from failures recorded before a restart
+func (c *catalog) loadSkipCache() {
+	failedDownloadsMu.Lock()
+	defer failedDownloadsMu.Unlock()
+	for _, record := range c.list() {
+		if !record.downloaded() && time.Since(record.SkippedAt) < failedDownloadTTL {
+			failedDownloads[camera.fileURL(record.Name)] = record.SkippedAt
+		}
+	}
+}
+
+// importExistingFiles adds files downloaded before the catalog existed
+func (c *catalog) importExistingFiles(storagePath string) {
+	count := 0
+	for _, subdir := range []string{"events", "recordings"} {
+		dir := filepath.Join(storagePath, subdir)
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				log.Warn(err)
+			}
+			continue
+		}
+		for _, file := range files {
+			// GPX tracks and subtitles are made from the GPS files, not downloaded
+			ext := strings.ToLower(filepath.Ext(file.Name()))
+			if file.IsDir() || strings.HasSuffix(file.Name(), partialSuffix) || ext == ".gpx" || ext == ".srt" {
+				continue
+			}
+			date, err := fileNameToDate(file.Name())
+			if err != nil {
+				log.Warn(err)
+				continue
+			}
+			err = c.update(file.Name(), func(r *fileRecord) {
+				r.Kind = guessKind(subdir, file.Name())
+				r.CameraTime = date
+				r.Size = file.Size()
+				r.DownloadedAt = file.ModTime()
+				r.Path = filepath.Join(dir, file.Name())
+			})
+			if err != nil {
+				log.Warn("Cannot import ", file.Name(), ": ", err)
+				continue
+			}
+			count++
+		}
+	}
+	log.Info("Imported ", count, " saved items into the catalog")
+}
+
+// Directories holding the videos stitched here
+var outputDirs = []struct {
+	subdir string
+	kind   fileKind
+}{
+	{"stitched", kindStitched},
+	{"trips", kindStitched},
+	{"timelapse", kindCondensed},
+}
+
+// importOutputs adds the stitched videos and timelapses on disk that the catalog does not know,
+// like those made before they were recorded. Their retention starts now.
+func (c *catalog) importOutputs(storagePath string) {
+	count := 0
+	for _, output := range outputDirs {
+		dir := filepath.Join(storagePath, output.subdir)
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				log.Warn(err)
+			}
+			continue
+		}
+		for _, file := range files {
+			if file.IsDir() || !strings.EqualFold(filepath.Ext(file.Name()), ".mp4") {
+				continue
+			}
+			if _, found := c.get(file.Name()); found {
+				continue
+			}
+			err = c.update(file.Name(), func(r *fileRecord) {
+				r.Kind = output.kind
+				r.CameraTime = file.ModTime() // Stitched videos carry the time of their first clip
+				r.Size = file.Size()
+				r.DownloadedAt = time.Now()
+				r.Path = filepath.Join(dir, file.Name())
+			})
+			if err != nil {
+				log.Warn("Cannot import ", file.Name(), ": ", err)
+				continue
+			}
+			count++
+		}
+	}
+	if count > 0 {
+		log.Info("Imported ", count, " stitched videos and timelapses into the catalog")
+	}
+}
+
+// guessKind works out the camera list a stored file came from
+func guessKind(subdir string, name string) fileKind {
+	ext := strings.ToLower(filepath.Ext(name))
+	switch {
+	case subdir == "events" && ext == ".jpg":
+		return kindThumbnail
+	case subdir == "events":
+		return kindEvent
+	case ext == ".mp4":
+		return kindRecording
+	default:
+		return kindGPS
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestCatalog replaces the catalog with an empty one for the length of the test
+// and returns its path
+func newTestCatalog(t *testing.T) string {
+	t.Helper()
+	saved := fileCatalog
+	path := filepath.Join(t.TempDir(), "catalog.db")
+	c, err := openCatalog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileCatalog = c
+	t.Cleanup(func() {
+		c.close()
+		fileCatalog = saved
+	})
+	return path
+}
+
+// addTestRecord stores a record for a file that is no longer on disk
+func addTestRecord(t *testing.T, name string, kind fileKind, fn func(*fileRecord)) {
+	t.Helper()
+	cameraTime, err := fileNameToDate(name)
+	if kind == kindStitched || kind == kindCondensed {
+		// Videos made here are named after their first recording, trip or parking session
+		cameraTime, err = time.ParseInLocation("20060102150405", name[:14], cameraTZ)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fileCatalog.update(name, func(r *fileRecord) {
+		r.Kind = kind
+		r.CameraTime = cameraTime
+		r.DownloadedAt = cameraTime.Add(time.Minute)
+		if fn != nil {
+			fn(r)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// addStoredFile writes a file of size bytes and records it in the catalog as stored
+func addStoredFile(t *testing.T, dir string, name string, kind fileKind, size int, fn func(*fileRecord)) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, make([]byte, size), 0600); err != nil {
+		t.Fatal(err)
+	}
+	addTestRecord(t, name, kind, func(r *fileRecord) {
+		r.Path = path
+		r.Size = int64(size)
+		if fn != nil {
+			fn(r)
+		}
+	})
+	return path
+}
+
+func TestImportOutputs(t *testing.T) {
+	newTestCatalog(t)
+	dir := t.TempDir()
+	firstClip := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	for _, path := range []string{
+		filepath.Join(dir, "stitched", "20230601120000-20230601130000.mp4"),
+		filepath.Join(dir, "trips", "20230601120000.mp4"),
+		filepath.Join(dir, "trips", "20230601120000.gpx"),
+		filepath.Join(dir, "timelapse", "20230601020000.mp4"),
+	} {
+		os.MkdirAll(filepath.Dir(path), 0700)
+		os.WriteFile(path, make([]byte, 2048), 0600)
+		os.Chtimes(path, firstClip, firstClip)
+	}
+	addTestRecord(t, "20230601120000.mp4", kindStitched, func(r *fileRecord) { r.Size = 1 })
+
+	fileCatalog.importOutputs(dir)
+	record, found := fileCatalog.get("20230601120000-20230601130000.mp4")
+	if !found || record.Kind != kindStitched || !record.stored() || record.Size != 2048 {
+		t.Fatalf("stitched range not imported: %+v", record)
+	}
+	if !record.CameraTime.Equal(firstClip) || time.Since(record.DownloadedAt) > time.Minute {
+		t.Errorf("imported times: camera %v, made %v", record.CameraTime, record.DownloadedAt)
+	}
+	if record, found := fileCatalog.get("20230601020000.mp4"); !found || record.Kind != kindCondensed {
+		t.Errorf("parking timelapse not imported: %+v", record)
+	}
+	if record, _ := fileCatalog.get("20230601120000.mp4"); record.Size != 1 {
+		t.Error("known record overwritten")
+	}
+	if _, found := fileCatalog.get("20230601120000.gpx"); found {
+		t.Error("trip export imported as a video")
+	}
+}
+
+func TestCatalogUsedBytes(t *testing.T) {
+	path := newTestCatalog(t)
+	dir := t.TempDir()
+	addStoredFile(t, dir, "20230601120000_0060.mp4", kindRecording, 3000, nil)
+	addStoredFile(t, dir, "20230601120100_0060.mp4", kindRecording, 2000, nil)
+	addTestRecord(t, "20230601120200_0060.mp4", kindRecording, func(r *fileRecord) { r.Size = 1000 })
+	if got := fileCatalog.usedBytes(); got != 5000 {
+		t.Fatalf("used %d bytes, want 5000", got)
+	}
+
+	fileCatalog.update("20230601120000_0060.mp4", func(r *fileRecord) { r.EvictedAt = time.Now() })
+	fileCatalog.remove("20230601120100_0060.mp4")
+	fileCatalog.update("20230601120200_0060.mp4", func(r *fileRecord) { r.Path = filepath.Join(dir, r.Name) })
+	if got := fileCatalog.usedBytes(); got != 1000 {
+		t.Fatalf("used %d bytes after evicting and removing, want 1000", got)
+	}
+
+	// Reopening counts the stored files again
+	fileCatalog.close()
+	c, err := openCatalog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileCatalog = c
+	if got := fileCatalog.usedBytes(); got != 1000 {
+		t.Errorf("used %d bytes after reopening, want 1000", got)
+	}
+}
+
+func TestCatalogListBetween(t *testing.T) {
+	newTestCatalog(t)
+	for _, name := range []string{
+		"20230601115900_0060.mp4",
+		"20230601120000_0060.mp4",
+		"20230601120500_0010_E.mp4",
+		"20230601121000_0060.git",
+		"20230601121100_0060.mp4",
+	} {
+		kind := kindRecording
+		if strings.HasSuffix(name, "_E.mp4") {
+			kind = kindEvent
+		}
+		addTestRecord(t, name, kind, nil)
+	}
+	addTestRecord(t, "20230601120000-20230601121000.mp4", kindStitched, nil)
+
+	from := time.Date(2023, 6, 1, 12, 0, 0, 0, cameraTZ)
+	var names []string
+	for _, record := range fileCatalog.listBetween(from, from.Add(10*time.Minute)) {
+		names = append(names, record.Name)
+	}
+	want := []string{"20230601120000_0060.mp4", "20230601120500_0010_E.mp4", "20230601121000_0060.git"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("got %v, want %v", names, want)
+	}
+}
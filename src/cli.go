@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// How long a command waits for a running downloader or for the catalog
+const commandTimeout = 2 * time.Second
+
+// runCommand runs a one-off command instead of the downloader and returns the exit code.
+// Commands only read, so they are safe to run next to a live downloader.
+func runCommand(args []string) int {
+	switch args[0] {
+	case "trips":
+		trips, err := loadTrips()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Cannot list the trips:", err)
+			return 1
+		}
+		printTrips(os.Stdout, trips)
+		return 0
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %q\nUsage: ddpai-downloader [trips]\n", args[0])
+		return 2
+	}
+}
+
+// loadTrips asks the downloader running on HTTP_PORT for the trips. When none answers
+// they are read from the catalog, as stored by the last run.
+func loadTrips() ([]trip, error) {
+	client := http.Client{Timeout: commandTimeout}
+	resp, err := client.Get("http://127.0.0.1:" + cfg.HttpPort + "/trips")
+	if err == nil {
+		defer resp.Body.Close()
+		var trips []trip
+		if resp.StatusCode == http.StatusOK && json.NewDecoder(resp.Body).Decode(&trips) == nil {
+			sort.SliceStable(trips, func(i, j int) bool { return trips[i].Start.Before(trips[j].Start) })
+			return trips, nil
+		}
+		log.Debug("Unexpected answer from port ", cfg.HttpPort, ": ", resp.Status)
+	} else {
+		log.Debug("No downloader running: ", err)
+	}
+
+	c, err := openCatalogReadOnly(cfg.CatalogPath, commandTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("no downloader answers on port %s and the catalog cannot be read: %w", cfg.HttpPort, err)
+	}
+	defer c.close()
+	return c.listTrips(), nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// useHTTPPort points the commands at a port for the length of the test
+func useHTTPPort(t *testing.T, port string) {
+	saved := cfg.HttpPort
+	cfg.HttpPort = port
+	t.Cleanup(func() { cfg.HttpPort = saved })
+}
+
+// closedPort returns a local port nothing listens on
+func closedPort(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	l.Close()
+	return port
+}
+
+func TestLoadTripsFromRunningDownloader(t *testing.T) {
+	start := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/trips" {
+			http.NotFound(w, r)
+			return
+		}
+		// Newest first, like tripsHandler
+		json.NewEncoder(w).Encode([]trip{{ID: "b", Start: start.Add(time.Hour)}, {ID: "a", Start: start}})
+	}))
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+	useHTTPPort(t, u.Port())
+
+	trips, err := loadTrips()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trips) != 2 || trips[0].ID != "a" || trips[1].ID != "b" {
+		t.Errorf("got %+v, want trips a and b, oldest first", trips)
+	}
+}
+
+func TestLoadTripsFromCatalog(t *testing.T) {
+	path := newTestCatalog(t)
+	useHTTPPort(t, closedPort(t))
+	saved := cfg.CatalogPath
+	cfg.CatalogPath = path
+	defer func() { cfg.CatalogPath = saved }()
+
+	addTestRecord(t, "20230601120000_0060.mp4", kindRecording, nil)
+	addTestRecord(t, "20230601120100_0060.mp4", kindRecording, nil)
+	addTestRecord(t, "20230601150000_0060.mp4", kindRecording, nil)
+	fileCatalog.rebuildTrips(5 * time.Minute)
+
+	// The downloader holds the catalog: nothing to read without its API
+	if _, err := loadTrips(); !errors.Is(err, bolt.ErrTimeout) {
+		t.Fatalf("got %v, want a timeout while the catalog is open", err)
+	}
+
+	fileCatalog.close()
+	trips, err := loadTrips()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trips) != 2 || len(trips[0].Clips) != 2 || len(trips[1].Clips) != 1 {
+		t.Errorf("got %+v, want 2 trips", trips)
+	}
+}
@@ -0,0 +1,10 @@
+//go:build windows
+
+package main
+
+import "errors"
+
+// diskFree is not implemented on Windows; MIN_FREE_BYTES is ignored there
+func diskFree(path string) (int64, error) {
+	return 0, errors.New("free disk space is not supported on windows")
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// downloadJob is a camera file queued for download
+type downloadJob struct {
+	file  File
+	path  string // Local destination
+	class downloadClass
+}
+
+// downloadAll hands the queued jobs to a pool of workers calling downloadFile.
+// After every completed file refresh may add jobs, so the queue is re-evaluated
+// before the next download starts. No new downloads are started once a shutdown
+// is requested; returns ErrExiting in that case.
+func downloadAll(queue *downloadQueue, workers int, timeout time.Duration, refresh func(*downloadQueue)) error {
+	jobs := make(chan downloadJob)
+	done := make(chan struct{})
+	for i := 0; i < workers; i++ {
+		go func() {
+			for job := range jobs {
+				runDownloadJob(job, timeout)
+				done <- struct{}{}
+			}
+		}()
+	}
+
+	active := 0
+	for !Exiting.Load() {
+		syncState.setQueue(queue)
+		// A worker is idle whenever fewer jobs than workers are running
+		if active < workers && queue.len() > 0 {
+			jobs <- queue.pop()
+			active++
+			continue
+		}
+		if active == 0 {
+			break
+		}
+		<-done
+		active--
+		if refresh != nil {
+			refresh(queue)
+		}
+	}
+	close(jobs)
+	for ; active > 0; active-- {
+		<-done
+	}
+
+	if Exiting.Load() {
+		return ErrExiting
+	}
+	return nil
+}
+
+func runDownloadJob(job downloadJob, timeout time.Duration) {
+	err, path := downloadFile(job.path, job.file, timeout)
+	if errors.Is(err, ErrSkipRecent) || errors.Is(err, ErrQuota) {
+		return
+	}
+	if err != nil {
+		log.Warn(err)
+		deleteFile(path)
+	}
+}
+
+// processDownload derives the local extras of a freshly downloaded file
+func processDownload(f File, path string) {
+	if f.kind != kindGPS && f.kind != kindRecording {
+		return
+	}
+	record, found := fileCatalog.get(f.name)
+	if !found {
+		return
+	}
+	if f.kind == kindGPS && cfg.GpxExport {
+		exportFileGPX(record)
+	}
+	if f.kind == kindRecording && cfg.Thumbnails {
+		// Made in the background; the file may be gone by then
+		queueThumbnailJob(func() {
+			if record, found := fileCatalog.get(f.name); found && record.stored() {
+				exportThumbnail(record)
+			}
+		})
+	}
+	// Subtitles need both the recording and its GPS file, whichever arrives last
+	if cfg.SrtExport {
+		exportSubtitles(record)
+	}
+}
+
+// removeDerivedFiles deletes what processDownload made from a file that is removed locally
+func removeDerivedFiles(record fileRecord) {
+	if record.Kind == kindGPS && record.Path != "" {
+		deleteFile(gpxPathFor(record))
+	}
+	if record.Kind == kindRecording && record.Path != "" {
+		deleteFile(srtPathFor(record))
+	}
+	if record.Thumbnail != "" {
+		deleteFile(record.Thumbnail)
+	}
+}
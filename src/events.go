@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	log "github.com/sirupsen/logrus"
+)
+
+// Types of the live events streamed on GET /events
+const (
+	eventCameraOnline      = "camera.online"
+	eventCameraOffline     = "camera.offline"
+	eventListFetched       = "list.fetched"
+	eventDownloadStarted   = "download.started"
+	eventDownloadProgress  = "download.progress"
+	eventDownloadCompleted = "download.completed"
+	eventDownloadFailed    = "download.failed"
+	eventFileDeleted       = "file.deleted"
+	eventSkipCacheAdded    = "skipcache.added"
+)
+
+// Events buffered per subscriber; a client that falls further behind misses events
+const eventBuffer = 64
+
+// SSE comment sent when nothing happened for a while, so proxies keep the stream open
+const eventKeepAlive = 15 * time.Second
+
+// liveEvent is one message on the event stream
+type liveEvent struct {
+	Type string      `json:"type"`
+	Time time.Time   `json:"time"`
+	Data interface{} `json:"data,omitempty"`
+}
+
+type listFetched struct {
+	List  string `json:"list"` // events, recordings or gps
+	Files int    `json:"files"`
+}
+
+type downloadResult struct {
+	Name     string   `json:"name"`
+	Category category `json:"category"`
+	Size     int64    `json:"size,omitempty"`
+	Duration float64  `json:"duration,omitempty"` // Seconds
+	Error    string   `json:"error,omitempty"`
+	Skipped  bool     `json:"skipped,omitempty"` // Added to the skip cache
+}
+
+type deletedFile struct {
+	Name     string   `json:"name"`
+	Category category `json:"category"`
+	Reason   string   `json:"reason"` // retention, quota, timelapse or manual
+}
+
+// eventHub fans the live events out to the connected clients
+type eventHub struct {
+	mu          sync.Mutex
+	subscribers map[chan liveEvent]struct{}
+}
+
+var liveEvents = &eventHub{subscribers: map[chan liveEvent]struct{}{}}
+
+// publish sends an event to every subscriber without waiting for slow ones
+func (h *eventHub) publish(eventType string, data interface{}) {
+	event := liveEvent{Type: eventType, Time: time.Now(), Data: data}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subscribers {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+func (h *eventHub) subscribe() chan liveEvent {
+	ch := make(chan liveEvent, eventBuffer)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.subscribers[ch] = struct{}{}
+	return ch
+}
+
+func (h *eventHub) unsubscribe(ch chan liveEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.subscribers, ch)
+}
+
+// publishDeleted counts a local file removal and tells the live clients about it
+func publishDeleted(record fileRecord, reason string) {
+	filesDeleted.WithLabelValues(string(record.category()), reason).Inc()
+	liveEvents.publish(eventFileDeleted, deletedFile{Name: record.Name, Category: record.category(), Reason: reason})
+}
+
+// eventsHandler streams the live events as server-sent events until the client
+// goes away or the downloader shuts down: GET /events
+func eventsHandler(c echo.Context) error {
+	ch := liveEvents.subscribe()
+	defer liveEvents.unsubscribe(ch)
+
+	w := c.Response()
+	w.Header().Set(echo.HeaderContentType, "text/event-stream")
+	w.Header().Set(echo.HeaderCacheControl, "no-cache")
+	w.Header().Set(echo.HeaderConnection, "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	w.Flush()
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case event := <-ch:
+			data, err := json.Marshal(event)
+			if err != nil {
+				log.Warn("Cannot encode live event ", event.Type, ": ", err)
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data); err != nil {
+				return nil
+			}
+			w.Flush()
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return nil
+			}
+			w.Flush()
+		case <-c.Request().Context().Done():
+			return nil
+		case <-quit:
+			return nil
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func subscriberCount() int {
+	liveEvents.mu.Lock()
+	defer liveEvents.mu.Unlock()
+	return len(liveEvents.subscribers)
+}
+
+func TestEventsHandlerStreamsEvents(t *testing.T) {
+	e := echo.New()
+	e.GET("/events", eventsHandler)
+	server := httptest.NewServer(e)
+	defer server.Close()
+
+	before := subscriberCount()
+	resp, err := http.Get(server.URL + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ct := resp.Header.Get(echo.HeaderContentType); ct != "text/event-stream" {
+		t.Errorf("content type %q", ct)
+	}
+	// The handler subscribes before it sends the headers
+	liveEvents.publish(eventFileDeleted, deletedFile{Name: "20230601120000_0060.mp4", Category: categoryContinuous, Reason: "quota"})
+
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		close(lines)
+	}()
+	next := func() string {
+		select {
+		case line := <-lines:
+			return line
+		case <-time.After(5 * time.Second):
+			t.Fatal("no event streamed")
+			return ""
+		}
+	}
+	if line := next(); line != "event: "+eventFileDeleted {
+		t.Fatalf("got %q, want the event type", line)
+	}
+	data, found := strings.CutPrefix(next(), "data: ")
+	if !found {
+		t.Fatal("no data line")
+	}
+	var event struct {
+		Type string      `json:"type"`
+		Data deletedFile `json:"data"`
+	}
+	if err := json.Unmarshal([]byte(data), &event); err != nil {
+		t.Fatal(err)
+	}
+	if event.Type != eventFileDeleted || event.Data.Name != "20230601120000_0060.mp4" || event.Data.Reason != "quota" {
+		t.Errorf("got %+v", event)
+	}
+
+	// Closing the stream drops the subscriber
+	resp.Body.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for subscriberCount() != before {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d subscribers after disconnect, want %d", subscriberCount(), before)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestEventHubSkipsSlowSubscribers(t *testing.T) {
+	ch := liveEvents.subscribe()
+	defer liveEvents.unsubscribe(ch)
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < eventBuffer*2; i++ {
+			liveEvents.publish(eventDownloadProgress, downloadResult{Name: "x"})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("publish blocked on a full subscriber")
+	}
+	if len(ch) != eventBuffer {
+		t.Errorf("%d buffered events, want %d", len(ch), eventBuffer)
+	}
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fakeQuirk makes the fake camera misbehave the way real cameras do
+type fakeQuirk int
+
+const (
+	quirkNone     fakeQuirk = iota
+	quirkEOF                // connection drops halfway through the transfer
+	quirkStub               // serves a 58-byte placeholder instead of the media
+	quirkZeroSize           // listed with size 0 as if it is still being written
+	quirkVanish             // listed, but gone by the time it is downloaded
+	quirkNoMoov             // served without its moov box, so it won't play
+	quirkBadSize            // listed with a size that is not a number
+)
+
+// Length of the events served by the fake camera
+const fakeEventLength = 10 * time.Second
+
+// Size of the placeholder files the camera serves for broken media
+const fakeStubSize = 58
+
+type fakeFile struct {
+	name   string
+	data   []byte
+	quirk  fakeQuirk
+	parent string // Video a GPS file belongs to
+}
+
+type fakeEvent struct {
+	index string
+	video *fakeFile
+	thumb *fakeFile
+}
+
+// fakeCamera is an in-process DDPAI camera. It answers /vcam/cmd.cgi commands
+// with the JsonHeader envelope and serves media bodies, so the sync loop can run
+// against an httptest server instead of a real dashcam.
+type fakeCamera struct {
+	mu         sync.Mutex
+	events     []*fakeEvent
+	recordings []*fakeFile
+	gpsFiles   []*fakeFile
+	files      map[string]*fakeFile
+	nextIndex  int
+}
+
+func newFakeCamera() *fakeCamera {
+	return &fakeCamera{
+		files: map[string]*fakeFile{},
+	}
+}
+
+// newSampleFakeCamera returns a fake camera holding a parking session, then an event and a few minutes of driving before now.
+// Each quirk is applied to its own recording so the downloader can be exercised against them.
+func newSampleFakeCamera(now time.Time, quirks ...fakeQuirk) *fakeCamera {
+	f := newFakeCamera()
+	start := now.Add(-10 * time.Minute).In(cameraTZ)
+	for i := 0; i < 3; i++ {
+		stamp := start.Add(time.Duration(i-30) * time.Minute).Format("20060102150405")
+		f.addRecording(stamp+"_0060_T.mp4", fakeMP4(32*1024, time.Minute))
+	}
+	for i := 0; i < 5+len(quirks); i++ {
+		stamp := start.Add(time.Duration(i) * time.Minute).Format("20060102150405")
+		f.addRecording(stamp+"_0060.mp4", fakeMP4(64*1024, time.Minute))
+		f.addGpsFile(stamp+"_0060.git", stamp+"_0060.mp4", fakeNMEA(start.Add(time.Duration(i)*time.Minute), time.Minute))
+		if i >= 5 {
+			f.setQuirk(stamp+"_0060.mp4", quirks[i-5])
+		}
+	}
+	stamp := start.Add(2 * time.Minute).Format("20060102150405")
+	f.addEvent(stamp+"_0010_E.mp4", fakeMP4(32*1024, 10*time.Second), stamp+"_0010_E.jpg", randomBytes(8*1024))
+	return f
+}
+
+// fakeMP4 builds a clip of roughly size bytes with an ftyp, a moov holding only an mvhd, and random mdat
+func fakeMP4(size int, duration time.Duration) []byte {
+	box := func(boxType string, body []byte) []byte {
+		b := make([]byte, 8, 8+len(body))
+		binary.BigEndian.PutUint32(b, uint32(8+len(body)))
+		copy(b[4:], boxType)
+		return append(b, body...)
+	}
+	ftyp := box("ftyp", []byte("isom\x00\x00\x02\x00isomavc1"))
+	mvhd := make([]byte, 100) // version 0
+	binary.BigEndian.PutUint32(mvhd[12:], 1000)
+	binary.BigEndian.PutUint32(mvhd[16:], uint32(duration.Milliseconds()))
+	moov := box("moov", box("mvhd", mvhd))
+	mdatSize := size - len(ftyp) - len(moov) - 8
+	if mdatSize < 0 {
+		mdatSize = 0
+	}
+	data := append(ftyp, moov...)
+	return append(data, box("mdat", randomBytes(mdatSize))...)
+}
+
+// Where the fake camera drives from, heading north-east at a steady speed
+const (
+	fakeOriginLat = 52.3676
+	fakeOriginLon = 4.9041
+	fakeSpeedKmh  = 50.0
+	fakeHeading   = 45.0
+)
+
+// fakeNMEA builds a GPS file with an RMC and a GGA sentence per second of the
+// given span. Positions continue from one file to the next.
+func fakeNMEA(from time.Time, span time.Duration) []byte {
+	var b bytes.Buffer
+	sentence := func(body string) {
+		var sum byte
+		for i := 0; i < len(body); i++ {
+			sum ^= body[i]
+		}
+		fmt.Fprintf(&b, "$%s*%02X\r\n", body, sum)
+	}
+	coordinate := func(value float64, width int, positive string, negative string) string {
+		hemisphere := positive
+		if value < 0 {
+			hemisphere, value = negative, -value
+		}
+		degrees := math.Floor(value)
+		return fmt.Sprintf("%0*.0f%07.4f,%s", width, degrees, (value-degrees)*60, hemisphere)
+	}
+	// Metres per degree of latitude; longitude degrees shrink with the latitude
+	const metresPerDegree = 111320.0
+	for t := from; t.Before(from.Add(span)); t = t.Add(time.Second) {
+		travelled := float64(t.Unix()) * fakeSpeedKmh / 3.6
+		travelled = math.Mod(travelled, 20000) // Stay within 20km of the origin
+		north := travelled * math.Cos(fakeHeading*math.Pi/180) / metresPerDegree
+		east := travelled * math.Sin(fakeHeading*math.Pi/180) / (metresPerDegree * math.Cos(fakeOriginLat*math.Pi/180))
+		lat := coordinate(fakeOriginLat+north, 2, "N", "S")
+		lon := coordinate(fakeOriginLon+east, 3, "E", "W")
+		utc := t.UTC()
+		clock := utc.Format("150405") + ".00"
+		sentence(fmt.Sprintf("GPRMC,%s,A,%s,%s,%.1f,%.1f,%s,,,A", clock, lat, lon, fakeSpeedKmh/1.852, fakeHeading, utc.Format("020106")))
+		sentence(fmt.Sprintf("GPGGA,%s,%s,%s,1,09,0.9,12.0,M,46.9,M,,", clock, lat, lon))
+	}
+	return b.Bytes()
+}
+
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	rand.Read(b)
+	return b
+}
+
+func (f *fakeCamera) addEvent(video string, data []byte, thumb string, thumbData []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.nextIndex++
+	event := &fakeEvent{index: strconv.Itoa(f.nextIndex), video: &fakeFile{name: video, data: data}}
+	f.files[video] = event.video
+	if thumb != "" {
+		event.thumb = &fakeFile{name: thumb, data: thumbData}
+		f.files[thumb] = event.thumb
+	}
+	f.events = append(f.events, event)
+}
+
+func (f *fakeCamera) addRecording(name string, data []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	file := &fakeFile{name: name, data: data}
+	f.files[name] = file
+	f.recordings = append(f.recordings, file)
+}
+
+func (f *fakeCamera) addGpsFile(name string, parent string, data []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	file := &fakeFile{name: name, data: data, parent: parent}
+	f.files[name] = file
+	f.gpsFiles = append(f.gpsFiles, file)
+}
+
+// setQuirk makes a listed file misbehave on the next listings and downloads
+func (f *fakeCamera) setQuirk(name string, quirk fakeQuirk) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if file, ok := f.files[name]; ok {
+		file.quirk = quirk
+	}
+}
+
+func (f *fakeCamera) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/":
+		w.WriteHeader(http.StatusOK)
+	case "/vcam/cmd.cgi":
+		f.serveCommand(w, r)
+	default:
+		f.serveMedia(w, r)
+	}
+}
+
+func (f *fakeCamera) serveCommand(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var data interface{}
+	switch r.URL.Query().Get("cmd") {
+	case "API_RequestSessionID":
+		data = Session{AcSessionID: "fake-session"}
+	case "API_RequestCertificate":
+		data = struct{}{}
+	case "APP_EventListReq":
+		data = f.eventList()
+	case "APP_PlaybackListReq":
+		data = f.playbackList()
+	case "API_GpsFileListReq":
+		data = f.gpsFileList()
+	case eventDeleteCmd:
+		var req struct {
+			Bvideoname string `json:"bvideoname"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || !f.deleteEvent(req.Bvideoname) {
+			writeFakeResponse(w, -1, struct{}{})
+			return
+		}
+		data = struct{}{}
+	default:
+		writeFakeResponse(w, -1, struct{}{})
+		return
+	}
+	writeFakeResponse(w, 0, data)
+}
+
+// writeFakeResponse wraps the payload in the camera's {errcode, data} envelope; data is a JSON string
+func writeFakeResponse(w http.ResponseWriter, errcode int, data interface{}) {
+	payload, _ := json.Marshal(data)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(JsonHeader{Errcode: errcode, Data: string(payload)})
+}
+
+func (f *fakeCamera) eventList() map[string]interface{} {
+	events := []map[string]string{}
+	for _, event := range f.events {
+		entry := map[string]string{
+			"index":      event.index,
+			"bvideoname": event.video.name,
+			"bvideosize": strconv.Itoa(listedSize(event.video)),
+		}
+		if event.video.quirk == quirkBadSize {
+			entry["bvideosize"] = "unknown"
+		}
+		if event.thumb != nil {
+			entry["imgname"] = event.thumb.name
+		}
+		if start, err := fileNameToDate(event.video.name); err == nil {
+			entry["bstarttime"] = strconv.FormatInt(start.Unix(), 10)
+			entry["bendtime"] = strconv.FormatInt(start.Add(fakeEventLength).Unix(), 10)
+		}
+		events = append(events, entry)
+	}
+	return map[string]interface{}{"num": len(events), "event": events}
+}
+
+func (f *fakeCamera) playbackList() map[string]interface{} {
+	files := []map[string]interface{}{}
+	for i, rec := range f.recordings {
+		files = append(files, map[string]interface{}{
+			"index": strconv.Itoa(i),
+			"name":  rec.name,
+			"size":  listedSize(rec),
+		})
+	}
+	return map[string]interface{}{"num": len(files), "file": files}
+}
+
+func (f *fakeCamera) gpsFileList() map[string]interface{} {
+	files := []map[string]string{}
+	for i, gps := range f.gpsFiles {
+		files = append(files, map[string]string{
+			"index":      strconv.Itoa(i),
+			"type":       "gps",
+			"name":       gps.name,
+			"parentfile": gps.parent,
+		})
+	}
+	return map[string]interface{}{"num": len(files), "file": files}
+}
+
+func listedSize(file *fakeFile) int {
+	if file.quirk == quirkZeroSize {
+		return 0
+	}
+	return len(file.data)
+}
+
+func (f *fakeCamera) deleteEvent(video string) bool {
+	for i, event := range f.events {
+		if event.video.name != video {
+			continue
+		}
+		delete(f.files, event.video.name)
+		if event.thumb != nil {
+			delete(f.files, event.thumb.name)
+		}
+		f.events = append(f.events[:i], f.events[i+1:]...)
+		return true
+	}
+	return false
+}
+
+func (f *fakeCamera) serveMedia(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/")
+	f.mu.Lock()
+	file, ok := f.files[name]
+	f.mu.Unlock()
+	if !ok || file.quirk == quirkVanish {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch file.quirk {
+	case quirkStub:
+		stub := file.data
+		if len(stub) > fakeStubSize {
+			stub = stub[:fakeStubSize]
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(stub)))
+		w.Write(stub)
+	case quirkNoMoov:
+		data := bytes.Replace(file.data, []byte("moov"), []byte("free"), 1)
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Write(data)
+	case quirkEOF:
+		// Promise the whole file, send half of it and drop the connection
+		w.Header().Set("Content-Length", strconv.Itoa(len(file.data)))
+		w.Write(file.data[:len(file.data)/2])
+		if flusher, ok := w.(http.Flusher); ok {
+			flusher.Flush()
+		}
+		panic(http.ErrAbortHandler)
+	default:
+		w.Header().Set("Content-Length", strconv.Itoa(len(file.data)))
+		w.Write(file.data)
+	}
+}
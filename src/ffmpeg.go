@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Bytes of ffmpeg's error output kept for the error message
+const ffmpegErrorTail = 512
+
+// runFFmpeg runs FFMPEG_PATH with args and stops it on shutdown. progress, if set,
+// receives how far into the output ffmpeg got, from its -progress output.
+func runFFmpeg(args []string, progress func(time.Duration)) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-quit:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	args = append([]string{"-hide_banner", "-nostdin", "-loglevel", "error", "-nostats", "-progress", "pipe:1", "-y"}, args...)
+	cmd := exec.CommandContext(ctx, cfg.FFmpegPath, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("cannot run %s: %w", cfg.FFmpegPath, err)
+	}
+	readFFmpegProgress(stdout, progress)
+	if err := cmd.Wait(); err != nil {
+		if ctx.Err() != nil {
+			return ErrExiting
+		}
+		tail := strings.TrimSpace(stderr.String())
+		if len(tail) > ffmpegErrorTail {
+			tail = tail[len(tail)-ffmpegErrorTail:]
+		}
+		return fmt.Errorf("ffmpeg: %w: %s", err, tail)
+	}
+	return nil
+}
+
+// readFFmpegProgress reads the key=value blocks of -progress until ffmpeg closes its output
+func readFFmpegProgress(r io.Reader, progress func(time.Duration)) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		key, value, found := strings.Cut(scanner.Text(), "=")
+		if !found || key != "out_time_us" || progress == nil {
+			continue
+		}
+		if us, err := strconv.ParseInt(value, 10, 64); err == nil && us >= 0 {
+			progress(time.Duration(us) * time.Microsecond)
+		}
+	}
+}
+
+// concatListEntry quotes a path for the ffmpeg concat demuxer list file
+func concatListEntry(path string) string {
+	return "file '" + strings.ReplaceAll(path, "'", `'\''`) + "'\n"
+}
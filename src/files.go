@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	log "github.com/sirupsen/logrus"
+)
+
+// Page size of GET /api/files
+const (
+	defaultFilesLimit = 100
+	maxFilesLimit     = 1000
+)
+
+// fileInfo is a downloaded file as the file API lists it
+type fileInfo struct {
+	Name         string    `json:"name"`
+	Type         fileKind  `json:"type"`
+	Category     category  `json:"category"`
+	Time         time.Time `json:"time"` // Camera time from the file name
+	Size         int64     `json:"size"`
+	Duration     float64   `json:"duration,omitempty"` // Seconds, for MP4 clips
+	DownloadedAt time.Time `json:"downloadedAt"`
+	Pinned       bool      `json:"pinned"`
+	Validation   string    `json:"validation,omitempty"`
+	URL          string    `json:"url"`
+}
+
+func newFileInfo(record fileRecord) fileInfo {
+	date, err := fileNameToDate(record.Name)
+	if err != nil {
+		date = record.CameraTime
+	}
+	return fileInfo{
+		Name:         record.Name,
+		Type:         record.Kind,
+		Category:     record.category(),
+		Time:         date,
+		Size:         record.Size,
+		Duration:     record.Duration,
+		DownloadedAt: record.DownloadedAt,
+		Pinned:       record.Pinned,
+		Validation:   record.Validation,
+		URL:          "/api/files/" + record.Name,
+	}
+}
+
+// fileFilter is the query of GET /api/files
+type fileFilter struct {
+	categories map[category]bool // Empty for all
+	from       time.Time
+	to         time.Time
+	pinned     *bool
+	validated  *bool
+	offset     int
+	limit      int
+}
+
+func parseFileFilter(c echo.Context) (filter fileFilter, err error) {
+	filter.limit = defaultFilesLimit
+	if value := c.QueryParam("category"); value != "" {
+		filter.categories = map[category]bool{}
+		for _, name := range strings.Split(value, ",") {
+			switch cat := category(strings.ToLower(strings.TrimSpace(name))); cat {
+			case categoryEvent, categoryContinuous, categoryTimelapse, categoryGPS, categoryStitched, categoryCondensed:
+				filter.categories[cat] = true
+			default:
+				return filter, fmt.Errorf("unknown category %q", name)
+			}
+		}
+	}
+	if value := c.QueryParam("from"); value != "" {
+		if filter.from, err = time.Parse(time.RFC3339, value); err != nil {
+			return filter, fmt.Errorf("from must be an RFC 3339 time")
+		}
+	}
+	if value := c.QueryParam("to"); value != "" {
+		if filter.to, err = time.Parse(time.RFC3339, value); err != nil {
+			return filter, fmt.Errorf("to must be an RFC 3339 time")
+		}
+	}
+	if filter.pinned, err = parseBoolParam(c, "pinned"); err != nil {
+		return filter, err
+	}
+	if filter.validated, err = parseBoolParam(c, "validated"); err != nil {
+		return filter, err
+	}
+	if value := c.QueryParam("offset"); value != "" {
+		if filter.offset, err = strconv.Atoi(value); err != nil || filter.offset < 0 {
+			return filter, fmt.Errorf("offset must be a positive number")
+		}
+	}
+	if value := c.QueryParam("limit"); value != "" {
+		if filter.limit, err = strconv.Atoi(value); err != nil || filter.limit < 1 || filter.limit > maxFilesLimit {
+			return filter, fmt.Errorf("limit must be between 1 and %d", maxFilesLimit)
+		}
+	}
+	return filter, nil
+}
+
+// parseBoolParam reads an optional true/false query parameter
+func parseBoolParam(c echo.Context, name string) (*bool, error) {
+	value := c.QueryParam(name)
+	if value == "" {
+		return nil, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return nil, fmt.Errorf("%s must be true or false", name)
+	}
+	return &b, nil
+}
+
+func (f fileFilter) match(info fileInfo) bool {
+	if len(f.categories) > 0 && !f.categories[info.Category] {
+		return false
+	}
+	if !f.from.IsZero() && info.Time.Before(f.from) {
+		return false
+	}
+	if !f.to.IsZero() && !info.Time.Before(f.to) {
+		return false
+	}
+	if f.pinned != nil && info.Pinned != *f.pinned {
+		return false
+	}
+	if f.validated != nil && (info.Validation == validationValid) != *f.validated {
+		return false
+	}
+	return true
+}
+
+// fileList is the body of GET /api/files
+type fileList struct {
+	Total  int        `json:"total"` // Matching files, over all pages
+	Offset int        `json:"offset"`
+	Limit  int        `json:"limit"`
+	Files  []fileInfo `json:"files"`
+}
+
+// filesHandler lists the files on disk, newest first: GET /api/files
+func filesHandler(c echo.Context) error {
+	filter, err := parseFileFilter(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	matching := []fileInfo{}
+	for _, record := range fileCatalog.list() {
+		if !record.stored() {
+			continue
+		}
+		if info := newFileInfo(record); filter.match(info) {
+			matching = append(matching, info)
+		}
+	}
+	sort.SliceStable(matching, func(i, j int) bool { return matching[i].Time.After(matching[j].Time) })
+
+	list := fileList{Total: len(matching), Offset: filter.offset, Limit: filter.limit, Files: []fileInfo{}}
+	if filter.offset < len(matching) {
+		end := filter.offset + filter.limit
+		if end > len(matching) {
+			end = len(matching)
+		}
+		list.Files = matching[filter.offset:end]
+	}
+	return c.JSON(http.StatusOK, list)
+}
+
+// fileHandler streams a downloaded file. Range requests let browsers seek in videos
+// and scripts resume; the ETag makes If-None-Match and If-Range work:
+// GET /api/files/:name
+func fileHandler(c echo.Context) error {
+	name := c.Param("name")
+	record, found := fileCatalog.get(name)
+	if !found || !record.stored() {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "file not on disk: " + name})
+	}
+	info, err := os.Stat(record.Path)
+	if err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "file not on disk: " + name})
+	}
+	c.Response().Header().Set("ETag", fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size()))
+	c.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("inline; filename=%q", name))
+	return c.File(record.Path)
+}
+
+// deleteFileHandler removes a downloaded file and what was derived from it. The
+// catalog keeps the record so the file is not downloaded again: DELETE /api/files/:name
+func deleteFileHandler(c echo.Context) error {
+	name := c.Param("name")
+	record, found := fileCatalog.get(name)
+	if !found || !record.stored() {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "file not on disk: " + name})
+	}
+	if record.Pinned {
+		return c.JSON(http.StatusConflict, map[string]string{"error": "file is pinned, unpin it first: " + name})
+	}
+	if err := os.Remove(record.Path); err != nil && !os.IsNotExist(err) {
+		log.Warn("Cannot delete ", record.Path, ": ", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "cannot delete " + name})
+	}
+	removeDerivedFiles(record)
+	err := fileCatalog.update(name, func(r *fileRecord) {
+		r.Path = ""
+		r.EvictedAt = time.Now()
+	})
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	publishDeleted(record, "manual")
+	log.Info("Deleted ", record.Path, " on request")
+	return c.NoContent(http.StatusNoContent)
+}
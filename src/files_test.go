@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// serveAPI sends a request to handler mounted on route and returns the response
+func serveAPI(method string, route string, handler echo.HandlerFunc, target string, header http.Header) *httptest.ResponseRecorder {
+	e := echo.New()
+	e.Add(method, route, handler)
+	req := httptest.NewRequest(method, target, nil)
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec
+}
+
+func listFiles(t *testing.T, query string) (list fileList) {
+	t.Helper()
+	rec := serveAPI(http.MethodGet, "/api/files", filesHandler, "/api/files?"+query, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("%s: status %d: %s", query, rec.Code, rec.Body)
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	return list
+}
+
+func fileNames(files []fileInfo) (names []string) {
+	for _, f := range files {
+		names = append(names, f.Name)
+	}
+	return names
+}
+
+func TestFilesHandlerFilters(t *testing.T) {
+	newTestCatalog(t)
+	saved := cameraTZ
+	cameraTZ = time.UTC
+	defer func() { cameraTZ = saved }()
+	dir := t.TempDir()
+	event := "20230601120500_0010_E.mp4"
+	clip := "20230601120000_0060.mp4"
+	parking := "20230601020000_0060_T.mp4"
+	gps := "20230601120100_0060.git"
+	addStoredFile(t, dir, event, kindEvent, 2048, nil)
+	addStoredFile(t, dir, clip, kindRecording, 2048, func(r *fileRecord) { r.Validation = validationValid })
+	addStoredFile(t, dir, parking, kindRecording, 2048, nil)
+	addStoredFile(t, dir, gps, kindGPS, 2048, nil)
+	if _, err := pin(clip, "manual"); err != nil {
+		t.Fatal(err)
+	}
+	// Evicted files are not listed
+	addTestRecord(t, "20230601130000_0060.mp4", kindRecording, func(r *fileRecord) { r.EvictedAt = time.Now() })
+
+	tests := []struct {
+		query string
+		total int
+		names []string
+	}{
+		{query: "", total: 4, names: []string{event, gps, clip, parking}},
+		{query: "category=event,Continuous", total: 2, names: []string{event, clip}},
+		{query: "category=timelapse", total: 1, names: []string{parking}},
+		{query: "pinned=true", total: 1, names: []string{clip}},
+		{query: "validated=false", total: 3, names: []string{event, gps, parking}},
+		{query: "from=2023-06-01T12:00:00Z&to=2023-06-01T12:05:00Z", total: 2, names: []string{gps, clip}},
+		{query: "limit=2&offset=1", total: 4, names: []string{gps, clip}},
+		{query: "offset=10", total: 4},
+	}
+	for _, tt := range tests {
+		list := listFiles(t, tt.query)
+		if list.Total != tt.total || !reflect.DeepEqual(fileNames(list.Files), tt.names) {
+			t.Errorf("%q: got %d %v, want %d %v", tt.query, list.Total, fileNames(list.Files), tt.total, tt.names)
+		}
+	}
+
+	for _, query := range []string{"category=bogus", "from=yesterday", "pinned=maybe", "offset=-1", "limit=0", "limit=1001"} {
+		if rec := serveAPI(http.MethodGet, "/api/files", filesHandler, "/api/files?"+query, nil); rec.Code != http.StatusBadRequest {
+			t.Errorf("%q: status %d, want %d", query, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestFileHandlerRangeAndETag(t *testing.T) {
+	newTestCatalog(t)
+	dir := t.TempDir()
+	name := "20230601120000_0060.mp4"
+	path := addStoredFile(t, dir, name, kindRecording, 2048, nil)
+	if err := os.WriteFile(path, []byte("0123456789"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	get := func(header http.Header) *httptest.ResponseRecorder {
+		return serveAPI(http.MethodGet, "/api/files/:name", fileHandler, "/api/files/"+name, header)
+	}
+
+	full := get(nil)
+	etag := full.Header().Get("ETag")
+	if full.Code != http.StatusOK || full.Body.String() != "0123456789" || etag == "" {
+		t.Fatalf("full download: status %d, body %q, ETag %q", full.Code, full.Body, etag)
+	}
+
+	part := get(http.Header{"Range": {"bytes=2-5"}})
+	if part.Code != http.StatusPartialContent || part.Body.String() != "2345" {
+		t.Errorf("range: status %d, body %q", part.Code, part.Body)
+	}
+	if got := part.Header().Get("Content-Range"); got != "bytes 2-5/10" {
+		t.Errorf("Content-Range %q", got)
+	}
+
+	if rec := get(http.Header{"If-None-Match": {etag}}); rec.Code != http.StatusNotModified {
+		t.Errorf("If-None-Match with the current ETag: status %d, want %d", rec.Code, http.StatusNotModified)
+	}
+	// A resume against a changed file gets the whole file again
+	rec := get(http.Header{"Range": {"bytes=2-5"}, "If-Range": {`"stale"`}})
+	if rec.Code != http.StatusOK || rec.Body.String() != "0123456789" {
+		t.Errorf("If-Range with an old ETag: status %d, body %q", rec.Code, rec.Body)
+	}
+
+	if rec := serveAPI(http.MethodGet, "/api/files/:name", fileHandler, "/api/files/20230601130000_0060.mp4", nil); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown file: status %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
+
+func TestDeleteFileHandler(t *testing.T) {
+	newTestCatalog(t)
+	dir := t.TempDir()
+	name := "20230601120000_0060.mp4"
+	pinned := "20230601120100_0060.mp4"
+	path := addStoredFile(t, dir, name, kindRecording, 2048, nil)
+	pinnedPath := addStoredFile(t, dir, pinned, kindRecording, 2048, nil)
+	if _, err := pin(pinned, "manual"); err != nil {
+		t.Fatal(err)
+	}
+	remove := func(name string) int {
+		return serveAPI(http.MethodDelete, "/api/files/:name", deleteFileHandler, "/api/files/"+name, nil).Code
+	}
+
+	if code := remove(name); code != http.StatusNoContent {
+		t.Fatalf("status %d, want %d", code, http.StatusNoContent)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("file still on disk")
+	}
+	record, found := fileCatalog.get(name)
+	if !found || record.stored() || record.EvictedAt.IsZero() {
+		t.Errorf("record not kept as evicted: %+v", record)
+	}
+	if code := remove(name); code != http.StatusNotFound {
+		t.Errorf("second delete: status %d, want %d", code, http.StatusNotFound)
+	}
+
+	if code := remove(pinned); code != http.StatusConflict {
+		t.Errorf("pinned file: status %d, want %d", code, http.StatusConflict)
+	}
+	if _, err := os.Stat(pinnedPath); err != nil {
+		t.Error("pinned file deleted: ", err)
+	}
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Knots to km/h
+const knotsToKmh = 1.852
+
+// ErrNoFixes means a track has no usable GPS positions to export.
+var ErrNoFixes = errors.New("no GPS fixes")
+
+// trackPoint is one GPS fix from the camera
+type trackPoint struct {
+	Time        time.Time `json:"time"`
+	Lat         float64   `json:"lat"`
+	Lon         float64   `json:"lon"`
+	Speed       float64   `json:"speed"`   // km/h
+	Heading     float64   `json:"heading"` // Degrees from true north
+	Fix         int       `json:"fix"`     // GGA fix quality, 0 = no fix
+	Satellites  int       `json:"satellites"`
+	Altitude    float64   `json:"altitude"` // Meters
+	HasAltitude bool      `json:"-"`        // Altitude came from a GGA sentence
+}
+
+// track is the parsed content of one GPS file
+type track struct {
+	Name   string       // GPS file name
+	Video  string       // Recording the GPS file belongs to, if known
+	Points []trackPoint // In time order
+}
+
+// parseGPSFile reads a camera GPS file. The camera stores NMEA sentences, either
+// as plain text or bundled in a tar archive of NMEA files.
+func parseGPSFile(path string) ([]trackPoint, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if !isTar(data) {
+		return parseNMEA(bytes.NewReader(data)), nil
+	}
+	var points []trackPoint
+	archive := tar.NewReader(bytes.NewReader(data))
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return points, fmt.Errorf("reading %s: %w", path, err)
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		points = append(points, parseNMEA(archive)...)
+	}
+	return points, nil
+}
+
+func isTar(data []byte) bool {
+	return len(data) > 262 && string(data[257:262]) == "ustar"
+}
+
+// parseNMEA turns RMC sentences into track points and adds the fix quality,
+// satellites and altitude of the GGA sentence with the same time
+func parseNMEA(r io.Reader) (points []trackPoint) {
+	index := map[string]int{} // hhmmss.ss -> point
+	var pendingGGA = map[string][]string{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields, ok := nmeaFields(scanner.Text())
+		if !ok || len(fields[0]) != 5 {
+			continue
+		}
+		// Talker (GP, GN, GL...) then the sentence type
+		switch fields[0][2:] {
+		case "RMC":
+			point, ok := parseRMC(fields)
+			if !ok {
+				continue
+			}
+			if gga, found := pendingGGA[fields[1]]; found {
+				applyGGA(&point, gga)
+				delete(pendingGGA, fields[1])
+			}
+			index[fields[1]] = len(points)
+			points = append(points, point)
+		case "GGA":
+			if len(fields) < 10 {
+				continue
+			}
+			if i, found := index[fields[1]]; found {
+				applyGGA(&points[i], fields)
+			} else {
+				pendingGGA[fields[1]] = fields
+			}
+		}
+	}
+	return points
+}
+
+// nmeaFields splits a sentence like $GPRMC,...*hh after checking its checksum
+func nmeaFields(line string) ([]string, bool) {
+	line = strings.TrimSpace(line)
+	start := strings.IndexByte(line, '$')
+	if start < 0 {
+		return nil, false
+	}
+	line = line[start+1:]
+	if star := strings.IndexByte(line, '*'); star >= 0 {
+		want, err := strconv.ParseUint(strings.TrimSpace(line[star+1:]), 16, 8)
+		if err != nil {
+			return nil, false
+		}
+		var sum byte
+		for i := 0; i < star; i++ {
+			sum ^= line[i]
+		}
+		if byte(want) != sum {
+			return nil, false
+		}
+		line = line[:star]
+	}
+	return strings.Split(line, ","), true
+}
+
+// parseRMC reads $xxRMC,hhmmss.ss,A,llll.ll,a,yyyyy.yy,a,speed,course,ddmmyy,...
+func parseRMC(fields []string) (trackPoint, bool) {
+	if len(fields) < 10 || fields[2] != "A" {
+		return trackPoint{}, false
+	}
+	stamp, err := parseNMEATime(fields[9], fields[1])
+	if err != nil {
+		return trackPoint{}, false
+	}
+	lat, err := parseNMEACoordinate(fields[3], fields[4])
+	if err != nil {
+		return trackPoint{}, false
+	}
+	lon, err := parseNMEACoordinate(fields[5], fields[6])
+	if err != nil {
+		return trackPoint{}, false
+	}
+	speed, _ := strconv.ParseFloat(fields[7], 64)
+	heading, _ := strconv.ParseFloat(fields[8], 64)
+	return trackPoint{
+		Time:    stamp,
+		Lat:     lat,
+		Lon:     lon,
+		Speed:   speed * knotsToKmh,
+		Heading: heading,
+		Fix:     1, // RMC status A; refined by GGA
+	}, true
+}
+
+// applyGGA reads $xxGGA,hhmmss.ss,llll.ll,a,yyyyy.yy,a,quality,satellites,hdop,altitude,...
+func applyGGA(point *trackPoint, fields []string) {
+	if quality, err := strconv.Atoi(fields[6]); err == nil {
+		point.Fix = quality
+	}
+	if satellites, err := strconv.Atoi(fields[7]); err == nil {
+		point.Satellites = satellites
+	}
+	if altitude, err := strconv.ParseFloat(fields[9], 64); err == nil {
+		point.Altitude = altitude
+		point.HasAltitude = true
+	}
+}
+
+// parseNMEATime combines ddmmyy and hhmmss(.ss), always UTC
+func parseNMEATime(date string, clock string) (time.Time, error) {
+	if len(date) != 6 || len(clock) < 6 {
+		return time.Time{}, fmt.Errorf("invalid NMEA time %q %q", date, clock)
+	}
+	stamp, err := time.Parse("020106150405", date+clock[:6])
+	if err != nil {
+		return time.Time{}, err
+	}
+	if len(clock) > 7 && clock[6] == '.' {
+		if fraction, err := strconv.ParseFloat("0"+clock[6:], 64); err == nil {
+			stamp = stamp.Add(time.Duration(fraction * float64(time.Second)))
+		}
+	}
+	return stamp, nil
+}
+
+// parseNMEACoordinate converts (d)ddmm.mmmm and a hemisphere into signed degrees
+func parseNMEACoordinate(value string, hemisphere string) (float64, error) {
+	dot := strings.IndexByte(value, '.')
+	if dot < 0 {
+		dot = len(value)
+	}
+	if dot < 3 {
+		return 0, fmt.Errorf("invalid NMEA coordinate %q", value)
+	}
+	degrees, err := strconv.ParseFloat(value[:dot-2], 64)
+	if err != nil {
+		return 0, err
+	}
+	minutes, err := strconv.ParseFloat(value[dot-2:], 64)
+	if err != nil {
+		return 0, err
+	}
+	coordinate := degrees + minutes/60
+	if hemisphere == "S" || hemisphere == "W" {
+		coordinate = -coordinate
+	}
+	return coordinate, nil
+}
+
+// GPX 1.1 document, see https://www.topografix.com/GPX/1/1/
+type gpxDocument struct {
+	XMLName xml.Name   `xml:"gpx"`
+	Xmlns   string     `xml:"xmlns,attr"`
+	XmlnsTP string     `xml:"xmlns:gpxtpx,attr"`
+	Version string     `xml:"version,attr"`
+	Creator string     `xml:"creator,attr"`
+	Tracks  []gpxTrack `xml:"trk"`
+}
+
+type gpxTrack struct {
+	Name     string       `xml:"name"`
+	Desc     string       `xml:"desc,omitempty"`
+	Segments []gpxSegment `xml:"trkseg"`
+}
+
+type gpxSegment struct {
+	Points []gpxPoint `xml:"trkpt"`
+}
+
+type gpxPoint struct {
+	Lat        string         `xml:"lat,attr"`
+	Lon        string         `xml:"lon,attr"`
+	Ele        *float64       `xml:"ele,omitempty"`
+	Time       string         `xml:"time"`
+	Fix        string         `xml:"fix,omitempty"`
+	Sat        int            `xml:"sat,omitempty"`
+	Extensions *gpxExtensions `xml:"extensions,omitempty"`
+}
+
+// Speed and course go in the Garmin TrackPointExtension, GPX only allows
+// elements of other namespaces in <extensions>
+const gpxTrackPointNS = "http://www.garmin.com/xmlschemas/TrackPointExtension/v2"
+
+type gpxExtensions struct {
+	TrackPoint gpxTrackPointExtension `xml:"gpxtpx:TrackPointExtension"`
+}
+
+type gpxTrackPointExtension struct {
+	Speed  float64 `xml:"gpxtpx:speed"`  // m/s
+	Course float64 `xml:"gpxtpx:course"` // Degrees
+}
+
+// encodeGPX renders the tracks as one GPX track, one segment per GPS file.
+// The linked videos go in the description.
+func encodeGPX(name string, tracks []track, videos []string) ([]byte, error) {
+	gpxTrk := gpxTrack{Name: name}
+	for _, t := range tracks {
+		var segment gpxSegment
+		for _, p := range t.Points {
+			point := gpxPoint{
+				Lat:        strconv.FormatFloat(p.Lat, 'f', 7, 64),
+				Lon:        strconv.FormatFloat(p.Lon, 'f', 7, 64),
+				Time:       p.Time.UTC().Format(time.RFC3339Nano),
+				Fix:        gpxFix(p.Fix),
+				Sat:        p.Satellites,
+				Extensions: &gpxExtensions{TrackPoint: gpxTrackPointExtension{Speed: p.Speed / 3.6, Course: p.Heading}},
+			}
+			if p.HasAltitude {
+				altitude := p.Altitude
+				point.Ele = &altitude
+			}
+			segment.Points = append(segment.Points, point)
+		}
+		if len(segment.Points) > 0 {
+			gpxTrk.Segments = append(gpxTrk.Segments, segment)
+		}
+	}
+	if len(gpxTrk.Segments) == 0 {
+		return nil, fmt.Errorf("%w for %s", ErrNoFixes, name)
+	}
+	gpxTrk.Desc = strings.Join(linkedVideos(tracks, videos), ", ")
+	doc := gpxDocument{
+		Xmlns:   "http://www.topografix.com/GPX/1/1",
+		XmlnsTP: gpxTrackPointNS,
+		Version: "1.1",
+		Creator: "ddpai_downloader",
+		Tracks:  []gpxTrack{gpxTrk},
+	}
+	data, err := xml.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), data...), nil
+}
+
+func gpxFix(quality int) string {
+	switch quality {
+	case 0:
+		return "none"
+	case 1:
+		return "3d"
+	case 2:
+		return "dgps"
+	default:
+		return ""
+	}
+}
+
+// writeFileAtomic writes through a .partial file so readers never see half a file
+func writeFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	partial := path + partialSuffix
+	if err := os.WriteFile(partial, data, 0644); err != nil {
+		removePartialFile(partial)
+		return err
+	}
+	return os.Rename(partial, path)
+}
+
+// loadTrack parses a downloaded GPS file of the catalog
+func loadTrack(record fileRecord) (track, error) {
+	points, err := parseGPSFile(record.Path)
+	return track{Name: record.Name, Video: record.Parent, Points: points}, err
+}
+
+// gpxPathFor is where the GPX of a GPS file goes: next to its video, or the GPS file itself
+func gpxPathFor(record fileRecord) string {
+	name := record.Name
+	if record.Parent != "" {
+		name = record.Parent
+	}
+	return filepath.Join(filepath.Dir(record.Path), strings.TrimSuffix(name, filepath.Ext(name))+".gpx")
+}
+
+// exportFileGPX writes the GPX next to a freshly downloaded GPS file
+func exportFileGPX(record fileRecord) {
+	t, err := loadTrack(record)
+	if err != nil {
+		log.Warn("Cannot parse GPS file ", record.Name, ": ", err)
+		return
+	}
+	if len(t.Points) == 0 {
+		log.Debug("No GPS fixes in ", record.Name)
+		return
+	}
+	path := gpxPathFor(record)
+	data, err := encodeGPX(record.Name, []track{t}, nil)
+	if err == nil {
+		err = writeFileAtomic(path, data)
+	}
+	if err != nil {
+		log.Warn("Cannot write GPX for ", record.Name, ": ", err)
+		return
+	}
+	log.Debug("Exported ", len(t.Points), " GPS fixes to ", path)
+}
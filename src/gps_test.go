@@ -0,0 +1,193 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// nmea adds the $ and checksum to a sentence body
+func nmea(body string) string {
+	var sum byte
+	for i := 0; i < len(body); i++ {
+		sum ^= body[i]
+	}
+	return fmt.Sprintf("$%s*%02X", body, sum)
+}
+
+func near(a, b float64) bool {
+	return math.Abs(a-b) < 1e-6
+}
+
+func TestParseNMEA(t *testing.T) {
+	lines := []string{
+		nmea("GPRMC,120000.00,A,5222.0560,N,00454.2460,E,10.0,45.0,010623,,,A"),
+		nmea("GPGGA,120000.00,5222.0560,N,00454.2460,E,1,09,0.9,12.5,M,46.9,M,,"),
+		// GGA ahead of its RMC
+		nmea("GNGGA,120001.50,3352.0000,S,15112.0000,W,2,11,0.8,3.0,M,0.0,M,,"),
+		nmea("GNRMC,120001.50,A,3352.0000,S,15112.0000,W,0.0,270.0,010623,,,A"),
+		// No GGA at all
+		nmea("GPRMC,120002.00,A,5222.0560,N,00454.2460,E,5.0,90.0,010623,,,A"),
+		// Void fix, bad checksum, unknown sentence and noise are skipped
+		nmea("GPRMC,120003.00,V,,,,,,,010623,,,N"),
+		strings.Replace(nmea("GPRMC,120004.00,A,5222.0560,N,00454.2460,E,5.0,90.0,010623,,,A"), "*", "0*", 1),
+		nmea("GPGSV,3,1,11,03,03,111,00"),
+		"garbage",
+	}
+	points := parseNMEA(strings.NewReader(strings.Join(lines, "\r\n")))
+	if len(points) != 3 {
+		t.Fatalf("got %d points, want 3: %+v", len(points), points)
+	}
+
+	p := points[0]
+	if !p.Time.Equal(time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)) {
+		t.Errorf("time %v", p.Time)
+	}
+	if !near(p.Lat, 52.3676) || !near(p.Lon, 4.9041) {
+		t.Errorf("position %v,%v", p.Lat, p.Lon)
+	}
+	if !near(p.Speed, 18.52) || p.Heading != 45 {
+		t.Errorf("speed %v heading %v", p.Speed, p.Heading)
+	}
+	if p.Fix != 1 || p.Satellites != 9 || p.Altitude != 12.5 || !p.HasAltitude {
+		t.Errorf("GGA not applied: %+v", p)
+	}
+
+	p = points[1]
+	if !p.Time.Equal(time.Date(2023, 6, 1, 12, 0, 1, 500000000, time.UTC)) {
+		t.Errorf("fractional time %v", p.Time)
+	}
+	if !near(p.Lat, -33.8666667) || !near(p.Lon, -151.2) {
+		t.Errorf("southern/western position %v,%v", p.Lat, p.Lon)
+	}
+	if p.Fix != 2 || p.Satellites != 11 || p.Altitude != 3 {
+		t.Errorf("earlier GGA not applied: %+v", p)
+	}
+
+	if p = points[2]; p.HasAltitude || p.Fix != 1 {
+		t.Errorf("RMC alone: %+v", p)
+	}
+}
+
+func TestParseNMEACoordinate(t *testing.T) {
+	tests := []struct {
+		value, hemisphere string
+		want              float64
+		err               bool
+	}{
+		{"5222.0560", "N", 52.3676, false},
+		{"00454.2460", "W", -4.9041, false},
+		{"3352", "S", -33.8666667, false},
+		{"52", "N", 0, true},
+		{"ab22.0560", "N", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parseNMEACoordinate(tt.value, tt.hemisphere)
+		if (err != nil) != tt.err || (!tt.err && !near(got, tt.want)) {
+			t.Errorf("parseNMEACoordinate(%q, %q) = %v, %v", tt.value, tt.hemisphere, got, err)
+		}
+	}
+}
+
+func TestParseGPSFileTar(t *testing.T) {
+	var archive bytes.Buffer
+	w := tar.NewWriter(&archive)
+	from := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	for i, name := range []string{"a.nmea", "b.nmea"} {
+		data := fakeNMEA(from.Add(time.Duration(i)*5*time.Second), 5*time.Second)
+		w.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), Typeflag: tar.TypeReg})
+		w.Write(data)
+	}
+	w.Close()
+	path := filepath.Join(t.TempDir(), "20230601120000_0060.git")
+	if err := os.WriteFile(path, archive.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	points, err := parseGPSFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(points) != 10 {
+		t.Fatalf("got %d points, want 10", len(points))
+	}
+	for i, p := range points {
+		if !p.Time.Equal(from.Add(time.Duration(i) * time.Second)) {
+			t.Errorf("point %d at %v", i, p.Time)
+		}
+		if math.Abs(p.Speed-fakeSpeedKmh) > 0.1 || p.Heading != fakeHeading || !p.HasAltitude {
+			t.Errorf("point %d: %+v", i, p)
+		}
+	}
+}
+
+func TestEncodeGPX(t *testing.T) {
+	from := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	tracks := []track{
+		{Name: "a.git", Video: "a.mp4", Points: []trackPoint{
+			{Time: from, Lat: 52.1, Lon: 4.1, Speed: 36, Heading: 90, Fix: 1, Satellites: 8, Altitude: 12, HasAltitude: true},
+			{Time: from.Add(time.Second), Lat: 52.2, Lon: 4.2, Speed: 72, Heading: 180, Fix: 1},
+		}},
+		{Name: "empty.git"},
+	}
+	data, err := encodeGPX("Trip", tracks, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc struct {
+		Xmlns  string `xml:"xmlns,attr"`
+		Tracks []struct {
+			Name     string `xml:"name"`
+			Desc     string `xml:"desc"`
+			Segments []struct {
+				Points []struct {
+					Lat    string   `xml:"lat,attr"`
+					Ele    *float64 `xml:"ele"`
+					Speed  float64  `xml:"extensions>TrackPointExtension>speed"`
+					Course float64  `xml:"extensions>TrackPointExtension>course"`
+				} `xml:"trkpt"`
+			} `xml:"trkseg"`
+		} `xml:"trk"`
+	}
+	if err := xml.Unmarshal(data, &doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc.Xmlns != "http://www.topografix.com/GPX/1/1" || len(doc.Tracks) != 1 {
+		t.Fatalf("unexpected document: %s", data)
+	}
+	trk := doc.Tracks[0]
+	if trk.Name != "Trip" || trk.Desc != "a.mp4" || len(trk.Segments) != 1 {
+		t.Fatalf("unexpected track: %s", data)
+	}
+	points := trk.Segments[0].Points
+	if len(points) != 2 || points[0].Lat != "52.1000000" {
+		t.Fatalf("unexpected points: %s", data)
+	}
+	if points[0].Ele == nil || *points[0].Ele != 12 || points[1].Ele != nil {
+		t.Errorf("elevation only wanted with an altitude: %s", data)
+	}
+	if points[0].Speed != 10 || points[1].Speed != 20 {
+		t.Errorf("speed not in m/s: %s", data)
+	}
+	// Extension elements must be in their own namespace
+	for _, element := range []string{"<gpxtpx:TrackPointExtension>", "<gpxtpx:speed>", "<gpxtpx:course>"} {
+		if !bytes.Contains(data, []byte(element)) {
+			t.Errorf("missing %s", element)
+		}
+	}
+	if !bytes.Contains(data, []byte(`xmlns:gpxtpx="`+gpxTrackPointNS+`"`)) {
+		t.Error("gpxtpx namespace not declared")
+	}
+
+	if _, err := encodeGPX("Nothing", []track{{Name: "empty.git"}}, nil); !errors.Is(err, ErrNoFixes) {
+		t.Errorf("got %v, want ErrNoFixes", err)
+	}
+}
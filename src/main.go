@@ -1,8 +1,6 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -12,6 +10,7 @@ import (
 	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -19,18 +18,25 @@ import (
 	"github.com/cavaliergopher/grab/v3"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "github.com/sirupsen/logrus"
 )
 
 // ErrSkipRecent means the file recently failed (e.g. EOF - likely deleted on camera); skip and continue with others.
 var ErrSkipRecent = errors.New("skip: recently failed, likely deleted on camera")
 
+// ErrIncomplete means fewer (or more) bytes arrived than the camera reported for the file.
+var ErrIncomplete = errors.New("incomplete download")
+
+// ErrExiting means a shutdown was requested; the sync stopped between two downloads.
+var ErrExiting = errors.New("exiting: shutdown requested")
+
 var (
-	FileHistory   = map[string]time.Time{}
-	Exiting       bool
-	cameraTZ      *time.Location
-	cfg           Config
-	camera        DdpaiCamera
+	Exiting     atomic.Bool
+	cameraTZ    *time.Location
+	cfg         Config
+	camera      Camera
+	fileCatalog *catalog
 )
 
 // failedDownloads caches URLs that recently failed with EOF (file likely deleted on camera); skip for a while.
@@ -40,80 +46,96 @@ var (
 	failedDownloadTTL = 15 * time.Minute
 )
 
-// Minimum size for valid video/photo files; smaller files are treated as corrupt (e.g. 58-byte stubs)
-const minValidFileSize = 1024
-
-type Config struct {
-	HttpPort       string        `env:"HTTP_PORT" envDefault:"8080"`
-	StoragePath    string        `env:"STORAGE_PATH" envDefault:"${PWD}" envExpand:"true"`
-	CamURL         string        `env:"CAM_URL" envDefault:"http://193.168.0.1"`
-	CameraTimeZone string        `env:"CAMERA_TIMEZONE" envDefault:"Local"`
-	Interval       time.Duration `env:"INTERVAL" envDefault:"30s"`
-	Timeout        time.Duration `env:"TIMEOUT" envDefault:"10s"`
-	HistoryLimit   time.Duration `env:"RECORDING_HISTORY" envDefault:"96h"`
-	LogLevel       string        `env:"LOG_LEVEL" envDefault:"info"`
+// pruneSkipCache drops the entries past failedDownloadTTL. Caller must hold failedDownloadsMu.
+func pruneSkipCache() {
+	for url, failedAt := range failedDownloads {
+		if time.Since(failedAt) >= failedDownloadTTL {
+			delete(failedDownloads, url)
+		}
+	}
 }
 
-type EventList struct {
-	Num   int `json:"num"`
-	Event []struct {
-		Index      string `json:"index"`
-		Imgname    string `json:"imgname"`
-		Bvideoname string `json:"bvideoname"`
-		Bstarttime string `json:"bstarttime"`
-		Bendtime   string `json:"bendtime"`
-		Bvideosize string `json:"bvideosize"`
-	} `json:"event"`
-}
+// Pause between two attempts at the same download
+var downloadRetryDelay = 5 * time.Second
 
-type PlaybackList struct {
-	Num  int `json:"num"`
-	File []struct {
-		Index     string `json:"index"`
-		Starttime string `json:"starttime"`
-		Endtime   string `json:"endtime"`
-		Name      string `json:"name"`
-		Size      int    `json:"size,omitempty"`
-	} `json:"file"`
-}
+// Suffix of files still being downloaded; renamed to the final name once validated
+const partialSuffix = ".partial"
 
-type GpsFileList struct {
-	Num  int `json:"num"`
-	File []struct {
-		Index      string `json:"index"`
-		Type       string `json:"type"`
-		Starttime  string `json:"starttime"`
-		Endtime    string `json:"endtime"`
-		Name       string `json:"name"`
-		Parentfile string `json:"parentfile"`
-	} `json:"file"`
-}
+// Minimum size for valid video/photo files; smaller files are treated as corrupt (e.g. 58-byte stubs)
+const minValidFileSize = 1024
 
-type Session struct {
-	AcSessionID string `json:"acSessionId"`
+type Config struct {
+	HttpPort         string        `env:"HTTP_PORT" envDefault:"8080"`
+	StoragePath      string        `env:"STORAGE_PATH" envDefault:"${PWD}" envExpand:"true"`
+	CatalogPath      string        `env:"CATALOG_PATH" envDefault:""`
+	CamURL           string        `env:"CAM_URL" envDefault:"http://193.168.0.1"`
+	CameraTimeZone   string        `env:"CAMERA_TIMEZONE" envDefault:"Local"`
+	Interval         time.Duration `env:"INTERVAL" envDefault:"30s"`
+	Timeout          time.Duration `env:"TIMEOUT" envDefault:"10s"`
+	HistoryLimit     time.Duration `env:"RECORDING_HISTORY" envDefault:"96h"`
+	EventHistory     time.Duration `env:"EVENT_HISTORY" envDefault:"2160h"`
+	TimelapseHistory time.Duration `env:"TIMELAPSE_HISTORY" envDefault:"168h"`
+	GpsHistory       time.Duration `env:"GPS_HISTORY" envDefault:"8760h"`
+	StitchedHistory  time.Duration `env:"STITCHED_HISTORY" envDefault:"168h"`
+	QuarantineLimit  time.Duration `env:"QUARANTINE_HISTORY" envDefault:"168h"`
+	MaxStorageBytes  int64         `env:"MAX_STORAGE_BYTES" envDefault:"0"`
+	MinFreeBytes     int64         `env:"MIN_FREE_BYTES" envDefault:"0"`
+	EvictionOrder    []string      `env:"EVICTION_ORDER" envDefault:"stitched,timelapse,condensed,continuous,gps,event" envSeparator:","`
+	PinEventWindow   time.Duration `env:"PIN_EVENT_WINDOW" envDefault:"0"`
+	GpxExport        bool          `env:"GPX_EXPORT" envDefault:"true"`
+	SrtExport        bool          `env:"SRT_EXPORT" envDefault:"true"`
+	MuxSubtitles     bool          `env:"MUX_SUBTITLES" envDefault:"false"`
+	TripGap          time.Duration `env:"TRIP_GAP" envDefault:"5m"`
+	TripExport       []string      `env:"TRIP_EXPORT" envDefault:"gpx" envSeparator:","`
+	StitchTrips      bool          `env:"STITCH_TRIPS" envDefault:"false"`
+	FFmpegPath       string        `env:"FFMPEG_PATH" envDefault:"ffmpeg"`
+	Thumbnails       bool          `env:"THUMBNAILS" envDefault:"false"`
+	ThumbnailWidth   int           `env:"THUMBNAIL_WIDTH" envDefault:"320"`
+	BuildTimelapse   bool          `env:"BUILD_TIMELAPSE" envDefault:"false"`
+	TimelapseSpeedup float64       `env:"TIMELAPSE_SPEEDUP" envDefault:"10"`
+	TimelapseCodec   string        `env:"TIMELAPSE_CODEC" envDefault:"libx264"`
+	CondensedHistory time.Duration `env:"TIMELAPSE_SOURCE_HISTORY" envDefault:"24h"`
+	ParkingHistory   time.Duration `env:"PARKING_TIMELAPSE_HISTORY" envDefault:"720h"`
+	MapTileURL       string        `env:"MAP_TILE_URL" envDefault:""`
+	MapMBTiles       string        `env:"MAP_MBTILES" envDefault:""`
+	MapAttribution   string        `env:"MAP_ATTRIBUTION" envDefault:""`
+	LogLevel         string        `env:"LOG_LEVEL" envDefault:"info"`
+	DownloadPriority []string      `env:"DOWNLOAD_PRIORITY" envDefault:"events,context,recent,gps,backfill" envSeparator:","`
+	RecentWindow     time.Duration `env:"RECENT_WINDOW" envDefault:"2h"`
+	DownloadWorkers  int           `env:"DOWNLOAD_WORKERS" envDefault:"1"`
+	DeleteEvents     bool          `env:"DELETE_EVENTS" envDefault:"false"`
+	DeleteDryRun     bool          `env:"DELETE_EVENTS_DRY_RUN" envDefault:"false"`
+
+	priorityRanks map[downloadClass]int // Parsed DownloadPriority
+	evictionRanks map[category]int      // Parsed EvictionOrder
 }
 
-type JsonHeader struct {
-	Errcode int    `json:"errcode"`
-	Data    string `json:"data"`
-}
+// fileKind is the camera list a file came from
+type fileKind string
+
+const (
+	kindEvent     fileKind = "event"
+	kindThumbnail fileKind = "thumbnail"
+	kindRecording fileKind = "recording"
+	kindGPS       fileKind = "gps"
+	kindStitched  fileKind = "stitched"  // Made here from recordings, not a camera list
+	kindCondensed fileKind = "condensed" // Parking timelapse made here
+)
 
 type File struct {
-	name string
-	url  string
-	date time.Time
+	kind      fileKind
+	name      string
+	url       string
+	date      time.Time
+	size      int64     // Size reported by the camera, 0 if unknown
+	index     string    // Camera index of the event this file belongs to
+	thumbnail string    // Thumbnail name for event videos
+	start     time.Time // Event videos: when the event starts
+	end       time.Time // Event videos: when the event ends
+	parent    string    // GPS files: the recording they belong to
 }
 type FileList []File
 
-type DdpaiCamera struct {
-	camPath      string
-	session      Session
-	eventList    EventList
-	playbackList PlaybackList
-	gpsFileList  GpsFileList
-	httpClient   http.Client
-}
-
 func init() {
 	cameraTZ = time.Local
 	cfg = Config{}
@@ -127,11 +149,23 @@ func init() {
 				cameraTZ = loc
 			}
 		}
+		if cfg.DownloadWorkers < 1 {
+			cfg.DownloadWorkers = 1
+		}
+		if cfg.TimelapseSpeedup < 1 {
+			cfg.TimelapseSpeedup = 1
+		}
+		cfg.priorityRanks = parsePriority(cfg.DownloadPriority)
+		cfg.TripExport = parseTripExport(cfg.TripExport)
+		cfg.evictionRanks = parseEvictionOrder(cfg.EvictionOrder)
 		// Set the default path to current dir
 		if cfg.StoragePath == "" {
 			currentDir, _ := os.Getwd()
 			cfg.StoragePath = currentDir
 		}
+		if cfg.CatalogPath == "" {
+			cfg.CatalogPath = filepath.Join(cfg.StoragePath, "catalog.db")
+		}
 		// Set the log level
 		switch strings.ToUpper(cfg.LogLevel) {
 		case "ERROR":
@@ -149,16 +183,35 @@ func init() {
 }
 
 func main() {
+	// Commands run next to a live downloader, so they come before anything touches the storage
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1:]))
+	}
 	camera = makeCamera(cfg.CamURL, 1*time.Second)
-	cleanupStubs(cfg.StoragePath)
-	updateTheFileHistory(cfg.StoragePath + "/recordings/")
-	go checkDashCam(cfg.StoragePath, cfg.Interval, cfg.Timeout, cfg.HistoryLimit)
+	sweepPartials(cfg.StoragePath)
+	var err error
+	fileCatalog, err = openCatalog(cfg.CatalogPath)
+	if err != nil {
+		log.Fatal("Cannot open the catalog: ", err)
+	}
+	defer fileCatalog.close()
+	if fileCatalog.count() == 0 {
+		fileCatalog.importExistingFiles(cfg.StoragePath)
+	}
+	fileCatalog.importOutputs(cfg.StoragePath)
+	fileCatalog.loadSkipCache()
+	fileCatalog.rebuildTrips(cfg.TripGap)
+	log.Info("Found ", fileCatalog.count(), " items in the catalog")
+	openMapTiles()
+	go stitchJobs.run()
+	go runThumbnailJobs()
+	go checkDashCam(cfg.StoragePath, cfg.Interval, cfg.Timeout)
 
 	e := echo.New()
 	e.Use(middleware.LoggerWithConfig(middleware.LoggerConfig{
 		Skipper: func(c echo.Context) bool {
 			path := c.Path()
-			return path == "/ping" || path == "/health"
+			return path == "/ping" || path == "/health" || path == "/metrics" || path == "/api/tiles/:z/:x/:y"
 		},
 	}))
 	e.Use(middleware.Recover())
@@ -166,6 +219,30 @@ func main() {
 		return c.JSON(http.StatusOK, struct{ Status string }{Status: "OK"})
 	})
 	e.GET("/health", healthHandler)
+	e.GET("/status", statusHandler)
+	e.GET("/events", eventsHandler)
+	e.GET("/metrics", echo.WrapHandler(promhttp.Handler()))
+	e.GET("/validation", func(c echo.Context) error {
+		return c.JSON(http.StatusOK, listValidationResults())
+	})
+	e.GET("/api/pins", pinsHandler)
+	e.POST("/api/files/:name/pin", pinHandler)
+	e.DELETE("/api/files/:name/pin", unpinHandler)
+	e.GET("/trips", tripsHandler)
+	e.GET("/api/trips/:id/:format", tripTrackHandler)
+	e.GET("/api/trips/:id/contactsheet", contactSheetHandler)
+	e.GET("/api/trips/:id/map", tripMapHandler)
+	e.GET("/api/thumbnails/:name", thumbnailHandler)
+	e.GET("/api/stitch", stitchJobsHandler)
+	e.POST("/api/stitch", stitchHandler)
+	e.GET("/api/stitch/:id", stitchJobHandler)
+	e.GET("/api/library", libraryHandler)
+	e.GET("/api/map", mapSettingsHandler)
+	e.GET("/api/tiles/:z/:x/:y", tileHandler)
+	e.GET("/api/files", filesHandler)
+	e.GET("/api/files/:name", fileHandler)
+	e.DELETE("/api/files/:name", deleteFileHandler)
+	e.StaticFS("/", echo.MustSubFS(webFiles, "web"))
 	e.Logger.Fatal(e.Start(":" + cfg.HttpPort))
 }
 
@@ -189,12 +266,12 @@ func healthHandler(c echo.Context) error {
 var quit = make(chan struct{})
 
 func SetupCloseHandler() {
-	c := make(chan os.Signal)
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-c
 		log.Warn("Ctrl+C pressed in Terminal. Waiting 60S for downloads to complete..")
-		Exiting = true
+		Exiting.Store(true)
 		close(quit)
 		exitTimer := time.NewTimer(60 * time.Second)
 		go func() {
@@ -205,112 +282,54 @@ func SetupCloseHandler() {
 	}()
 }
 
-func checkDashCam(mediaPath string, interval time.Duration, timeout time.Duration, historyLimit time.Duration) {
+func checkDashCam(mediaPath string, interval time.Duration, timeout time.Duration) {
 	ticker := time.NewTicker(interval)
 	go func() {
 		for {
 			select {
 			case <-ticker.C:
 				// Exit when you can. This will help to prevent half written files
-				if Exiting {
+				if Exiting.Load() {
 					os.Exit(0)
 				}
 
 				// Delete old videos
-				count := checkHistory(historyLimit)
+				syncState.setPhase(phaseCleaning)
+				count := checkHistory()
 				if count > 0 {
 					log.Info("Cleaned out ", count, " historic files...")
+					fileCatalog.rebuildTrips(cfg.TripGap)
+					pruneTripFiles(mediaPath)
 				}
+				pruneQuarantine(mediaPath)
+				enforceQuota()
 
 				// Check whether camera can be reach before doing any requests
+				syncState.setPhase(phaseConnecting)
 				if camera.connect() {
-					// Get Event files
-					log.Info("getting the event list...")
-					err, eventList := camera.getEvents()
-					if err != nil {
-						log.Info("something went wrong with event list...")
-						log.Warn(err)
-						break
+					cameraReachable.Set(1)
+					if syncState.setCamera(true, camera.hasSession()) {
+						liveEvents.publish(eventCameraOnline, nil)
 					}
-					log.Info(len(eventList), " Event files found")
-					for _, event := range eventList {
-						err, path := downloadFile(mediaPath+"/events/"+event.name, event.url, timeout, event.date)
-						if errors.Is(err, ErrSkipRecent) {
-							continue
-						}
-						if err != nil {
-							log.Warn(err)
-							deleteFile(path)
-							continue
-						}
-						// After done Downloading if asked, exit. This will help to prevent half written files
-						if Exiting {
-							os.Exit(0)
-						}
+					syncState.startSync()
+					err := syncCamera(mediaPath, timeout)
+					syncState.endSync(err)
+					syncState.setPhase(phaseIdle)
+					// After done Downloading if asked, exit. This will help to prevent half written files
+					if errors.Is(err, ErrExiting) {
+						os.Exit(0)
 					}
-
-					// Get timelapse and continuous recordings
-					err, recordingList := camera.getRecordings()
 					if err != nil {
 						log.Warn(err)
-						break
-					}
-					log.Info(len(recordingList), " Recording files found")
-					for _, recording := range recordingList {
-						// Skip downloading old files
-						if recording.date.Before(time.Now().Add(-historyLimit)) {
-							log.Debug("Skipping .... Recording ", recording.name, " too old")
-							continue
-						}
-						// Download
-						err, path := downloadFile(mediaPath+"/recordings/"+recording.name, recording.url, timeout, recording.date)
-						if errors.Is(err, ErrSkipRecent) {
-							continue
-						}
-						if err != nil {
-							log.Warn(err)
-							deleteFile(path)
-							continue
-						}
-						// Save the file name in the history
-						FileHistory[path] = recording.date
-						// After done Downloading if asked, exit. This will help to prevent half written files
-						if Exiting {
-							os.Exit(0)
-						}
-					}
-
-					// Get GPS files
-					err, gpsList := camera.getGpsFiles()
-					if err != nil {
-						log.Warn(err)
-						break
-					}
-					log.Info(len(gpsList), " GPS files found")
-					for _, gpsFile := range gpsList {
-						// Skip downloading old files
-						if gpsFile.date.Before(time.Now().Add(-historyLimit)) {
-							log.Debug("Skipping .... GPS ", gpsFile.name, " too old")
-							continue
-						}
-						// Download
-						err, path := downloadFile(mediaPath+"/recordings/"+gpsFile.name, gpsFile.url, timeout, gpsFile.date)
-						if errors.Is(err, ErrSkipRecent) {
-							continue
-						}
-						if err != nil {
-							log.Warn(err)
-							deleteFile(path)
-							continue
-						}
-						// Save the file name in the history
-						FileHistory[path] = gpsFile.date
-						// After done Downloading if asked, exit. This will help to prevent half written files
-						if Exiting {
-							os.Exit(0)
-						}
+					} else {
+						lastSuccessfulSync.SetToCurrentTime()
 					}
 				} else {
+					cameraReachable.Set(0)
+					if syncState.setCamera(false, false) {
+						liveEvents.publish(eventCameraOffline, nil)
+					}
+					syncState.setPhase(phaseIdle)
 					log.Warn("Cannot reach the Camera.. trying again in ", interval.String())
 				}
 			case <-quit:
@@ -322,29 +341,151 @@ func checkDashCam(mediaPath string, interval time.Duration, timeout time.Duratio
 	}()
 }
 
+// syncCamera downloads the events, recordings and GPS files from a reachable camera
+// in DOWNLOAD_PRIORITY order. Returns ErrExiting if a shutdown was requested.
+func syncCamera(mediaPath string, timeout time.Duration) error {
+	queue := newDownloadQueue(cfg.priorityRanks)
+
+	// Get Event files
+	syncState.setPhase(phaseEvents)
+	log.Info("getting the event list...")
+	err, eventList := camera.getEvents()
+	if err != nil {
+		log.Info("something went wrong with event list...")
+		return err
+	}
+	log.Info(len(eventList), " Event files found")
+	observeListing(eventList, categoryEvent)
+	liveEvents.publish(eventListFetched, listFetched{List: "events", Files: len(eventList)})
+	for _, event := range eventList {
+		// Skip downloading old files
+		if expired(event.kind, event.name, event.date) {
+			log.Debug("Skipping .... Event ", event.name, " too old")
+			continue
+		}
+		queue.push(downloadJob{file: event, path: mediaPath + "/events/" + event.name, class: classEvent})
+	}
+
+	// Get timelapse and continuous recordings, then GPS files. A failed listing
+	// still lets the files listed so far download.
+	syncState.setPhase(phaseRecordings)
+	listErr := listRecordings(queue, mediaPath, eventList)
+
+	// Pick up events recorded while we are downloading so they jump the line
+	refresh := func(q *downloadQueue) {
+		err, latest := camera.getEvents()
+		if err != nil {
+			log.Debug("Could not refresh the event list: ", err)
+			return
+		}
+		for _, event := range latest {
+			if expired(event.kind, event.name, event.date) {
+				continue
+			}
+			if q.push(downloadJob{file: event, path: mediaPath + "/events/" + event.name, class: classEvent}) {
+				log.Info("New event queued: ", event.name)
+				eventList = append(eventList, event)
+				// Recordings around the new event move up too
+				q.promote(classContext, func(job downloadJob) bool { return isEventContext(job.file, FileList{event}) })
+			}
+		}
+	}
+	syncState.setPhase(phaseDownloading)
+	if err := downloadAll(queue, cfg.DownloadWorkers, timeout, refresh); err != nil {
+		return err
+	}
+
+	// Group the new files into trips and rebuild the exports of the trips that changed
+	syncState.setPhase(phaseProcessing)
+	changed := fileCatalog.rebuildTrips(cfg.TripGap)
+	exportTrips(mediaPath, changed)
+	pruneTripFiles(mediaPath)
+	if cfg.Thumbnails {
+		queueThumbnailJob(func() { exportContactSheets(changed) })
+	}
+	if cfg.StitchTrips {
+		stitchFinishedTrips()
+	}
+	if cfg.BuildTimelapse {
+		buildTimelapses()
+	}
+
+	// Remove events from the camera once we have a verified copy
+	if cfg.DeleteEvents {
+		syncState.setPhase(phaseDeleting)
+		deleteDownloadedEvents(mediaPath+"/events/", eventList)
+	}
+	return listErr
+}
+
+// listRecordings queues the recordings and GPS files within their retention.
+// Files around one of the events are queued as event context.
+func listRecordings(queue *downloadQueue, mediaPath string, eventList FileList) error {
+	err, recordingList := camera.getRecordings()
+	if err != nil {
+		return err
+	}
+	log.Info(len(recordingList), " Recording files found")
+	observeListing(recordingList, categoryContinuous, categoryTimelapse)
+	liveEvents.publish(eventListFetched, listFetched{List: "recordings", Files: len(recordingList)})
+	for _, recording := range recordingList {
+		// Skip downloading old files
+		if expired(recording.kind, recording.name, recording.date) {
+			log.Debug("Skipping .... Recording ", recording.name, " too old")
+			continue
+		}
+		class := recordingClass(recording.date, cfg.RecentWindow)
+		if isEventContext(recording, eventList) {
+			class = classContext
+		}
+		queue.push(downloadJob{
+			file:  recording,
+			path:  mediaPath + "/recordings/" + recording.name,
+			class: class,
+		})
+	}
+
+	err, gpsList := camera.getGpsFiles()
+	if err != nil {
+		return err
+	}
+	log.Info(len(gpsList), " GPS files found")
+	observeListing(gpsList, categoryGPS)
+	liveEvents.publish(eventListFetched, listFetched{List: "gps", Files: len(gpsList)})
+	for _, gpsFile := range gpsList {
+		// Skip downloading old files
+		if expired(gpsFile.kind, gpsFile.name, gpsFile.date) {
+			log.Debug("Skipping .... GPS ", gpsFile.name, " too old")
+			continue
+		}
+		class := classGPS
+		if isEventContext(gpsFile, eventList) {
+			class = classContext
+		}
+		queue.push(downloadJob{
+			file:  gpsFile,
+			path:  mediaPath + "/recordings/" + gpsFile.name,
+			class: class,
+		})
+	}
+	return nil
+}
+
 // Download media from the camera
-func downloadFile(path string, url string, timeout time.Duration, timestamp time.Time) (err error, file string) {
+func downloadFile(path string, f File, timeout time.Duration) (err error, file string) {
 	p := filepath.FromSlash(path)
-	log.WithFields(log.Fields{"file": p, "url": url})
+	url := f.url
 
 	// If we already have a valid file, succeed regardless of failed cache (file exists = success)
-	_, found := FileHistory[p]
-	if found {
+	if record, found := fileCatalog.get(f.name); found && record.downloaded() {
 		log.Debug("File already downloaded ", p)
 		return nil, p
 	}
-	if info, err := os.Stat(p); err == nil && info.Size() >= minValidFileSize {
-		log.Debug("Skipping File ", p, " (valid, ", info.Size(), " bytes)")
-		return nil, p
-	}
-	if info, err := os.Stat(p); err == nil && info.Size() < minValidFileSize {
-		log.Warn("Removing corrupt stub (", info.Size(), " bytes) for retry: ", p)
-		os.Remove(p)
-	}
 
 	// Skip files that recently failed with EOF (only when we don't already have the file)
 	failedDownloadsMu.Lock()
-	if t, ok := failedDownloads[url]; ok && time.Since(t) < failedDownloadTTL {
+	pruneSkipCache()
+	if _, ok := failedDownloads[url]; ok {
 		failedDownloadsMu.Unlock()
 		log.Debug("Skipping ", url, " (recently failed): ", p)
 		return ErrSkipRecent, p
@@ -355,38 +496,70 @@ func downloadFile(path string, url string, timeout time.Duration, timestamp time
 		return err, p
 	}
 
+	// Make room for the file, or skip it when the storage limits can't be met
+	release, err := reserveSpace(f.name, f.size, f.date)
+	if err != nil {
+		return err, p
+	}
+	defer release()
+
+	syncState.startDownload(p, f)
+	defer syncState.finishDownload(p)
+	result := downloadResult{Name: f.name, Category: fileCategory(f.kind, f.name), Size: f.size}
+	liveEvents.publish(eventDownloadStarted, result)
+
 	const maxRetries = 3
-	const retryDelay = 5 * time.Second
 	var lastErr error
 	for attempt := 1; attempt <= maxRetries; attempt++ {
 		if attempt > 1 {
-			log.Info("Retrying download (attempt ", attempt, "/", maxRetries, ") after ", retryDelay, ": ", url)
-			time.Sleep(retryDelay)
+			log.Info("Retrying download (attempt ", attempt, "/", maxRetries, ") after ", downloadRetryDelay, ": ", url)
+			downloadRetries.Inc()
+			time.Sleep(downloadRetryDelay)
 		} else {
 			log.Info("Downloading File ", url)
 		}
-		lastErr, p = doDownload(p, url, timeout, timestamp)
+		started := time.Now()
+		lastErr, p = doDownload(p, url, f.size, timeout, f.date)
 		if lastErr == nil {
+			observeDownload(f, p, time.Since(started))
+			result.Duration = time.Since(started).Seconds()
+			if info, err := os.Stat(p); err == nil {
+				result.Size = info.Size()
+			}
+			liveEvents.publish(eventDownloadCompleted, result)
+			fileCatalog.recordDownload(f, p)
+			processDownload(f, p)
 			return nil, p
 		}
 		log.Warn("Download failed: ", lastErr)
 	}
 	// EOF/connection reset: only cache if we don't have a valid file (avoid false positives when file exists)
+	skipped := false
 	if lastErr != nil && (strings.Contains(lastErr.Error(), "EOF") || strings.Contains(lastErr.Error(), "connection reset")) {
-		if info, err := os.Stat(p); err != nil || info.Size() < minValidFileSize {
+		if _, err := os.Stat(p); err != nil {
 			failedDownloadsMu.Lock()
 			failedDownloads[url] = time.Now()
 			failedDownloadsMu.Unlock()
+			skipped = true
+			liveEvents.publish(eventSkipCacheAdded, skipEntry{URL: url, FailedAt: time.Now(), RetryAt: time.Now().Add(failedDownloadTTL)})
 			log.Info("Marking as skipped for 15m: ", url)
 		}
 	}
+	downloadFailures.WithLabelValues(string(fileCategory(f.kind, f.name))).Inc()
+	result.Error, result.Skipped = lastErr.Error(), skipped
+	liveEvents.publish(eventDownloadFailed, result)
+	fileCatalog.recordFailure(f, lastErr, skipped)
 	return lastErr, p
 }
 
-func doDownload(path string, url string, timeout time.Duration, timestamp time.Time) (err error, file string) {
+// doDownload fetches the file into a .partial file next to the destination and only
+// renames it into place once it is complete and validated.
+func doDownload(path string, url string, size int64, timeout time.Duration, timestamp time.Time) (err error, file string) {
 	p := filepath.FromSlash(path)
+	partial := p + partialSuffix
+	removePartialFile(partial)
 	client := grab.NewClient()
-	req, err := grab.NewRequest(filepath.Dir(p), url)
+	req, err := grab.NewRequest(partial, url)
 	if err != nil {
 		return fmt.Errorf("Failed to connect"), p
 	}
@@ -402,6 +575,9 @@ Loop:
 		select {
 		case <-t.C:
 			log.Debug("Progress ", fmt.Sprintf("%.2f", 100*resp.Progress()))
+			if progress, found := syncState.downloadProgress(p, resp); found {
+				liveEvents.publish(eventDownloadProgress, progress)
+			}
 			if lastProgress == resp.Progress() {
 				if errorCount == 2 {
 					log.Warn("Download not progressing. Timing out in ", timeout.Seconds())
@@ -411,300 +587,159 @@ Loop:
 				errorCount = 0
 				lastProgress = resp.Progress()
 			}
-			if Exiting {
+			if Exiting.Load() {
 				resp.Cancel()
+				removePartialFile(partial)
 				return fmt.Errorf("Downloading Stopped"), p
 			}
 			if errorCount*2 > int(timeout.Seconds()) {
 				resp.Cancel()
+				removePartialFile(partial)
 				return fmt.Errorf("Download Timeout"), p
 			}
 		case <-resp.Done:
 			break Loop
 		}
 	}
+	// Fall back to the Content-Length when the camera does not list a size
+	expected := size
+	if expected <= 0 {
+		expected = resp.Size()
+	}
+	written, sizeErr := checkDownloadSize(partial, expected)
 	if err := resp.Err(); err != nil {
-		// Camera may report EOF when transfer actually completed; if we got substantial data, treat as success
-		if resp.Size() >= minValidFileSize {
-			log.Info("Download completed with EOF (camera quirk); file valid: ", resp.Size(), " bytes")
-			if e := os.Chtimes(resp.Filename, time.Now().Local(), timestamp); e != nil {
-				log.Warn(e)
+		// Camera may report EOF when transfer actually completed; only trust it if every byte arrived
+		if sizeErr != nil || expected <= 0 {
+			removePartialFile(partial)
+			if errors.Is(sizeErr, ErrIncomplete) {
+				return fmt.Errorf("%v: %w", err, sizeErr), p
 			}
-			return nil, p
+			return err, p
 		}
-		removePartialFile(resp.Filename)
-		return err, p
-	}
-	// Validate file size; reject corrupt stubs (e.g. 58-byte placeholder)
-	if resp.Size() < minValidFileSize {
-		removePartialFile(resp.Filename)
-		return fmt.Errorf("file too small (%d bytes), likely corrupt", resp.Size()), p
-	}
-	if err := os.Chtimes(resp.Filename, time.Now().Local(), timestamp); err != nil {
-		log.Warn(err)
-	}
-	log.Info("Download completed ", resp.Duration(), " size:", resp.Size())
-	return nil, p
-}
-
-func removePartialFile(path string) {
-	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
-		log.Warn("Failed to remove partial file ", path, ": ", err)
-	}
-}
-
-func deleteFile(path string) {
-	log.Debug("Deleting file ", path)
-	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
-		log.Warn("Failed to delete file ", path, ": ", err)
+		log.Info("Download completed with EOF (camera quirk); file complete: ", written, " bytes")
+	} else if sizeErr != nil {
+		removePartialFile(partial)
+		return sizeErr, p
+	} else {
+		log.Info("Download completed ", resp.Duration(), " size:", written)
 	}
-}
-
-func cleanupStubs(storagePath string) {
-	for _, subdir := range []string{"recordings", "events"} {
-		dir := filepath.Join(storagePath, subdir)
-		files, err := ioutil.ReadDir(dir)
-		if err != nil {
-			if !os.IsNotExist(err) {
-				log.Warn("Cannot read ", dir, ": ", err)
-			}
-			continue
-		}
-		for _, f := range files {
-			if f.Size() < minValidFileSize {
-				p := filepath.Join(dir, f.Name())
-				log.Warn("Removing corrupt stub (", f.Size(), " bytes) on startup: ", p)
-				os.Remove(p)
-			}
+	// Broken clips are quarantined and retried
+	if isMP4(p) {
+		if err := checkMP4(partial, filepath.Base(p)); err != nil {
+			return err, p
 		}
 	}
+	return finishDownload(partial, p, timestamp), p
 }
 
-func updateTheFileHistory(path string) {
-	p := filepath.FromSlash(path)
-	files, err := ioutil.ReadDir(p)
+// checkDownloadSize compares the bytes on disk with the expected size (<= 0 if unknown)
+// and rejects corrupt stubs (e.g. 58-byte placeholder).
+func checkDownloadSize(path string, expected int64) (written int64, err error) {
+	info, err := os.Stat(path)
 	if err != nil {
-		log.Warn(err)
-		return
+		return 0, err
 	}
-
-	for _, file := range files {
-		if file.Size() < minValidFileSize {
-			continue // Stubs already cleaned by cleanupStubs; skip from history
-		}
-		date, err := camera.fileNameToDate(file.Name())
-		if err != nil {
-			log.Warn(err)
-		} else {
-			FileHistory[filepath.Join(p, file.Name())] = date
-		}
+	written = info.Size()
+	if written < minValidFileSize {
+		return written, fmt.Errorf("file too small (%d bytes), likely corrupt", written)
 	}
-	log.Info("Found ", len(FileHistory), " saved items locally")
-}
-
-func checkHistory(length time.Duration) (count int) {
-	for fileName, date := range FileHistory {
-		if date.Before(time.Now().Add(-length)) {
-			count++
-			deleteFile(fileName)
-			delete(FileHistory, fileName)
-		}
+	if expected > 0 && written != expected {
+		return written, fmt.Errorf("%w: got %d of %d bytes", ErrIncomplete, written, expected)
 	}
-	return count
+	return written, nil
 }
 
-func makeCamera(camPath string, timeout time.Duration) DdpaiCamera {
-	return DdpaiCamera{
-		camPath:    camPath,
-		httpClient: http.Client{Timeout: timeout},
+// finishDownload stamps the camera time on a validated .partial file and renames it into place
+func finishDownload(partial string, path string, timestamp time.Time) error {
+	if err := os.Chtimes(partial, time.Now().Local(), timestamp); err != nil {
+		log.Warn(err)
 	}
-}
-
-func (c *DdpaiCamera) connect() bool {
-	_, err := c.httpClient.Get(c.camPath)
-	if err != nil {
-		c.reset()
-		return false
-	} else {
-		if c.session.AcSessionID == "" {
-			c.auth()
-			c.requestCert()
-		}
-		return true
+	if err := os.Rename(partial, path); err != nil {
+		removePartialFile(partial)
+		return fmt.Errorf("failed to move download into place: %w", err)
 	}
+	return nil
 }
 
-func (c *DdpaiCamera) reset() {
-	c.session.AcSessionID = ""
-}
-
-func (c *DdpaiCamera) getRecordings() (error, FileList) {
-	var list FileList
-	err := c.getJson(c.camPath+"/vcam/cmd.cgi?cmd=APP_PlaybackListReq", &c.playbackList)
-	if err != nil {
-		c.reset()
-		return err, list
-	}
-
-	// Get timelapse and continuous recordings
-	for i := range c.playbackList.File {
-		rec := c.playbackList.File[len(c.playbackList.File)-i-1]
-		if rec.Name == "" {
-			log.Warn("Skipping recording entry with no filename, index: ", rec.Index)
+// deleteDownloadedEvents removes events from the camera whose video and thumbnail
+// are stored locally and match the size reported by the camera.
+func deleteDownloadedEvents(eventPath string, eventList FileList) {
+	for _, event := range eventList {
+		// Thumbnails are validated and deleted along with their video
+		if event.index == "" {
 			continue
 		}
-		if rec.Size <= 0 {
-			log.Debug("Skipping recording still being written (size 0): ", rec.Name)
+		if err := verifyEventDownload(eventPath, event); err != nil {
+			log.Warn("Not deleting event ", event.name, " from camera: ", err)
 			continue
 		}
-		date, err := c.fileNameToDate(rec.Name)
-		if err != nil {
-			log.Warn("Skipping recording with unparseable filename: ", rec.Name, " error: ", err)
-			continue
-		}
-		// Download
-		list = append(list, File{
-			name: rec.Name,
-			url:  c.camPath + "/" + rec.Name,
-			date: date,
-		})
-	}
-	return nil, list
-}
-
-func (c *DdpaiCamera) getEvents() (error, FileList) {
-	var list FileList
-	err := c.getJson(c.camPath+"/vcam/cmd.cgi?cmd=APP_EventListReq", &c.eventList)
-	if err != nil {
-		c.reset()
-		return err, list
-	}
-
-	// Get Event files
-	for _, event := range c.eventList.Event {
-		// Skip malformed entries with no video file (e.g. corrupt/incomplete camera events)
-		if event.Bvideoname == "" {
-			log.Warn("Skipping malformed event entry with no video file, index: ", event.Index)
+		if cfg.DeleteDryRun {
+			log.Info("Dry run: would delete event ", event.name, " from camera")
 			continue
 		}
-		if event.Bvideosize == "" || event.Bvideosize == "0" {
-			log.Debug("Skipping event still being written (no size): ", event.Bvideoname)
+		if err := camera.deleteEvent(event); err != nil {
+			log.Warn("Failed to delete event ", event.name, " from camera: ", err)
 			continue
 		}
-		date, err := c.fileNameToDate(event.Bvideoname)
-		if err != nil {
-			// Skip entries where the filename can't be parsed instead of stopping everything
-			log.Warn("Skipping event with unparseable filename: ", event.Bvideoname, " error: ", err)
-			continue
-		}
-		list = append(list, File{
-			name: event.Bvideoname,
-			url:  c.camPath + "/" + event.Bvideoname,
-			date: date,
-		})
-		// Only add thumbnail if it exists
-		if event.Imgname != "" {
-			list = append(list, File{
-				name: event.Imgname,
-				url:  c.camPath + "/" + event.Imgname,
-				date: date,
-			})
-		}
+		log.Info("Deleted event ", event.name, " from camera")
 	}
-	return nil, list
 }
 
-func (c *DdpaiCamera) getGpsFiles() (error, FileList) {
-	var list FileList
-	err := c.getJson(c.camPath+"/vcam/cmd.cgi?cmd=API_GpsFileListReq", &c.gpsFileList)
+// verifyEventDownload checks the local copy of an event video and its thumbnail.
+func verifyEventDownload(eventPath string, event File) error {
+	p := filepath.Join(filepath.FromSlash(eventPath), event.name)
+	info, err := os.Stat(p)
 	if err != nil {
-		c.reset()
-		return err, list
+		return fmt.Errorf("local copy missing: %w", err)
 	}
-
-	// Get GPS files
-	for _, gpsF := range c.gpsFileList.File {
-		if gpsF.Name == "" {
-			log.Warn("Skipping GPS file entry with no filename, index: ", gpsF.Index)
-			continue
-		}
-		date, err := c.fileNameToDate(gpsF.Name)
+	if event.size <= 0 {
+		return fmt.Errorf("camera did not report a size")
+	}
+	if info.Size() != event.size {
+		return fmt.Errorf("local size %d does not match camera size %d", info.Size(), event.size)
+	}
+	if event.thumbnail != "" {
+		thumb, err := os.Stat(filepath.Join(filepath.FromSlash(eventPath), event.thumbnail))
 		if err != nil {
-			log.Warn("Skipping GPS file with unparseable filename: ", gpsF.Name, " error: ", err)
-			continue
+			return fmt.Errorf("local thumbnail missing: %w", err)
+		}
+		if thumb.Size() < minValidFileSize {
+			return fmt.Errorf("local thumbnail too small (%d bytes)", thumb.Size())
 		}
-		list = append(list, File{
-			name: gpsF.Name,
-			url:  c.camPath + "/" + gpsF.Name,
-			date: date,
-		})
 	}
-	return nil, list
+	return nil
 }
 
-// Get the json output from the API call
-func (c DdpaiCamera) getJson(url string, target interface{}) error {
-
-	req, _ := http.NewRequest("GET", url, nil)
-	if c.session.AcSessionID != "" {
-		req.Header.Set("sessionid", c.session.AcSessionID)
-	}
-	resp, err := c.httpClient.Do(req)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-
-	// Remove the header
-	var jsonDump JsonHeader
-	err = json.NewDecoder(resp.Body).Decode(&jsonDump)
-	if err != nil {
-		return err
+func removePartialFile(path string) {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		log.Warn("Failed to remove partial file ", path, ": ", err)
 	}
-
-	return json.Unmarshal([]byte(jsonDump.Data), &target)
 }
 
-func (c *DdpaiCamera) auth() {
-	c.getJson(c.camPath+"/vcam/cmd.cgi?cmd=API_RequestSessionID", &c.session)
-}
-
-func (c DdpaiCamera) fileNameToDate(fileName string) (stamp time.Time, err error) {
-	if fileName == "" {
-		return time.Time{}, fmt.Errorf("invalid filename format: %q", fileName)
-	}
-	split := strings.Split(fileName, "_")
-	var datePart string
-	if len(split) == 4 {
-		datePart = split[1]
-	} else {
-		datePart = split[0]
-	}
-	if datePart == "" || len(datePart) != 14 {
-		return time.Time{}, fmt.Errorf("invalid filename format: %q", fileName)
-	}
-	date, err := time.ParseInLocation("20060102150405", datePart, cameraTZ)
-	if err != nil {
-		return time.Time{}, fmt.Errorf("invalid filename format: %q", fileName)
+func deleteFile(path string) {
+	log.Debug("Deleting file ", path)
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		log.Warn("Failed to delete file ", path, ": ", err)
 	}
-	return date, nil
 }
 
-func (c DdpaiCamera) requestCert() error {
-
-	var jsonData = []byte(`{
-		"user": "admin",
-		"password": "admin",
-		"level": 0,
-		"uid": "f2cf6a332999fbc3"}`)
-	request, _ := http.NewRequest("POST", c.camPath+"/vcam/cmd.cgi?cmd=API_RequestCertificate", bytes.NewBuffer(jsonData))
-	request.Header.Set("Cookie", "SessionID="+c.session.AcSessionID)
-	request.Header.Set("sessionid", c.session.AcSessionID)
-	request.Header.Set("Content-Type", "application/json")
-	response, err := c.httpClient.Do(request)
-	if err != nil {
-		return err
+// sweepPartials removes downloads left unfinished by a crash or eviction
+func sweepPartials(storagePath string) {
+	for _, subdir := range []string{"recordings", "events", "trips", "stitched", "thumbnails", "timelapse"} {
+		dir := filepath.Join(storagePath, subdir)
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				log.Warn("Cannot read ", dir, ": ", err)
+			}
+			continue
+		}
+		for _, f := range files {
+			if strings.HasSuffix(f.Name(), partialSuffix) {
+				p := filepath.Join(dir, f.Name())
+				log.Warn("Removing unfinished download on startup: ", p)
+				removePartialFile(p)
+			}
+		}
 	}
-	defer response.Body.Close()
-	return nil
 }
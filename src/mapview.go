@@ -0,0 +1,185 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	log "github.com/sirupsen/logrus"
+)
+
+// Events further than this from the nearest GPS fix are left off the map
+const maxMarkerGap = time.Minute
+
+// mapTiles is the MBTiles file set by MAP_MBTILES, nil when tiles come from MAP_TILE_URL or not at all
+var mapTiles *mbtiles
+
+// openMapTiles opens MAP_MBTILES; the map works without tiles if it cannot be read
+func openMapTiles() {
+	if cfg.MapMBTiles == "" {
+		return
+	}
+	tiles, err := openMBTiles(cfg.MapMBTiles)
+	if err != nil {
+		log.Warn("Cannot open MAP_MBTILES ", cfg.MapMBTiles, ": ", err)
+		return
+	}
+	mapTiles = tiles
+	log.Info("Serving map tiles from ", cfg.MapMBTiles, ", zoom ", tiles.minZoom, "-", tiles.maxZoom)
+}
+
+// mapSettings tells the UI where to get map tiles from
+type mapSettings struct {
+	Tiles       string    `json:"tiles"` // URL template with {z}, {x} and {y}, empty without tiles
+	Attribution string    `json:"attribution,omitempty"`
+	MinZoom     int       `json:"minZoom"`
+	MaxZoom     int       `json:"maxZoom"`
+	Bounds      []float64 `json:"bounds,omitempty"` // West, south, east, north
+}
+
+// mapSettingsHandler returns the tile settings of the map: GET /api/map
+func mapSettingsHandler(c echo.Context) error {
+	settings := mapSettings{Tiles: cfg.MapTileURL, Attribution: cfg.MapAttribution, MaxZoom: 19}
+	if mapTiles != nil {
+		settings.Tiles = "api/tiles/{z}/{x}/{y}"
+		settings.MinZoom, settings.MaxZoom, settings.Bounds = mapTiles.minZoom, mapTiles.maxZoom, mapTiles.bounds
+		if settings.Attribution == "" {
+			settings.Attribution = mapTiles.attribution
+		}
+	}
+	return c.JSON(http.StatusOK, settings)
+}
+
+// tileHandler serves a tile of MAP_MBTILES: GET /api/tiles/:z/:x/:y
+func tileHandler(c echo.Context) error {
+	if mapTiles == nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "MAP_MBTILES is not set"})
+	}
+	z, errZ := strconv.Atoi(c.Param("z"))
+	x, errX := strconv.Atoi(c.Param("x"))
+	y, errY := strconv.Atoi(strings.TrimSuffix(c.Param("y"), filepath.Ext(c.Param("y"))))
+	if errZ != nil || errX != nil || errY != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid tile position"})
+	}
+	data, err := mapTiles.tile(z, x, y)
+	if errors.Is(err, ErrNoTile) {
+		return c.NoContent(http.StatusNotFound)
+	}
+	if err != nil {
+		log.Warn("Cannot read tile ", z, "/", x, "/", y, ": ", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "cannot read tile"})
+	}
+	c.Response().Header().Set(echo.HeaderCacheControl, "max-age=86400")
+	return c.Blob(http.StatusOK, mapTiles.contentType, data)
+}
+
+type mapPoint struct {
+	Time  time.Time `json:"time"`
+	Lat   float64   `json:"lat"`
+	Lon   float64   `json:"lon"`
+	Speed float64   `json:"speed"` // km/h
+}
+
+type mapClip struct {
+	Name  string    `json:"name"`
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+type mapEvent struct {
+	Name      string    `json:"name"`
+	Time      time.Time `json:"time"`
+	Lat       float64   `json:"lat"`
+	Lon       float64   `json:"lon"`
+	Stored    bool      `json:"stored"` // The video can be played
+	Thumbnail bool      `json:"thumbnail"`
+}
+
+// tripMap is what the map page draws for a trip: the track, the recordings to seek
+// in and the events along the way
+type tripMap struct {
+	Trip   trip       `json:"trip"`
+	Points []mapPoint `json:"points"`
+	Clips  []mapClip  `json:"clips"`
+	Events []mapEvent `json:"events"`
+}
+
+func buildTripMap(t trip) tripMap {
+	m := tripMap{Trip: t, Points: []mapPoint{}, Clips: []mapClip{}, Events: []mapEvent{}}
+	for _, tr := range loadTracks(t.gpsRecords()) {
+		for _, p := range tr.Points {
+			m.Points = append(m.Points, mapPoint{Time: p.Time, Lat: p.Lat, Lon: p.Lon, Speed: p.Speed})
+		}
+	}
+	sort.SliceStable(m.Points, func(i, j int) bool { return m.Points[i].Time.Before(m.Points[j].Time) })
+
+	for _, name := range t.Clips {
+		if record, found := fileCatalog.get(name); found && record.stored() {
+			start, end := record.clipSpan()
+			m.Clips = append(m.Clips, mapClip{Name: name, Start: start, End: end})
+		}
+	}
+
+	records := fileCatalog.list()
+	thumbnails := map[string]bool{}
+	for _, record := range records {
+		if record.Kind == kindThumbnail && record.stored() {
+			thumbnails[record.Name] = true
+		}
+	}
+	for _, record := range records {
+		if record.Kind != kindEvent {
+			continue
+		}
+		start, end := record.eventSpan()
+		if end.Before(t.Start) || start.After(t.End) {
+			continue
+		}
+		p, found := nearestPoint(m.Points, start)
+		if !found {
+			continue
+		}
+		m.Events = append(m.Events, mapEvent{
+			Name:      record.Name,
+			Time:      start,
+			Lat:       p.Lat,
+			Lon:       p.Lon,
+			Stored:    record.stored(),
+			Thumbnail: thumbnails[strings.TrimSuffix(record.Name, filepath.Ext(record.Name))+".jpg"],
+		})
+	}
+	return m
+}
+
+// nearestPoint finds the fix closest in time to at, if one is within maxMarkerGap.
+// Points must be sorted by time.
+func nearestPoint(points []mapPoint, at time.Time) (mapPoint, bool) {
+	i := sort.Search(len(points), func(i int) bool { return !points[i].Time.Before(at) })
+	best := -1
+	for _, j := range []int{i - 1, i} {
+		if j < 0 || j >= len(points) {
+			continue
+		}
+		if best < 0 || absDuration(points[j].Time.Sub(at)) < absDuration(points[best].Time.Sub(at)) {
+			best = j
+		}
+	}
+	if best < 0 || absDuration(points[best].Time.Sub(at)) > maxMarkerGap {
+		return mapPoint{}, false
+	}
+	return points[best], true
+}
+
+// tripMapHandler returns the track, recordings and events of a trip: GET /api/trips/:id/map
+func tripMapHandler(c echo.Context) error {
+	t, found := fileCatalog.getTrip(c.Param("id"))
+	if !found {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "no trip " + c.Param("id")})
+	}
+	return c.JSON(http.StatusOK, buildTripMap(t))
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	_ "modernc.org/sqlite"
+)
+
+// ErrNoTile means the MBTiles file has no tile at the requested position
+var ErrNoTile = errors.New("no such tile")
+
+// Content types of the raster tile formats MBTiles files can hold
+var tileContentTypes = map[string]string{
+	"png":  "image/png",
+	"jpg":  "image/jpeg",
+	"jpeg": "image/jpeg",
+	"webp": "image/webp",
+}
+
+// mbtiles serves raster tiles from an MBTiles (SQLite) file
+type mbtiles struct {
+	db          *sql.DB
+	contentType string
+	minZoom     int
+	maxZoom     int
+	bounds      []float64 // West, south, east, north
+	attribution string
+}
+
+// openMBTiles opens an MBTiles file read-only and reads its metadata
+func openMBTiles(path string) (*mbtiles, error) {
+	db, err := sql.Open("sqlite", "file:"+(&url.URL{Path: path}).EscapedPath()+"?mode=ro")
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.Query("SELECT name, value FROM metadata")
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	defer rows.Close()
+	metadata := map[string]string{}
+	for rows.Next() {
+		var name, value string
+		if err := rows.Scan(&name, &value); err != nil {
+			db.Close()
+			return nil, err
+		}
+		metadata[name] = value
+	}
+	if err := rows.Err(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	format := strings.ToLower(metadata["format"])
+	if format == "" {
+		format = "png" // Default of the MBTiles spec
+	}
+	m := &mbtiles{db: db, contentType: tileContentTypes[format], maxZoom: 19, attribution: metadata["attribution"]}
+	if m.contentType == "" {
+		db.Close()
+		return nil, fmt.Errorf("tile format %q is not supported, only raster tiles are", format)
+	}
+	if zoom, err := strconv.Atoi(metadata["minzoom"]); err == nil {
+		m.minZoom = zoom
+	}
+	if zoom, err := strconv.Atoi(metadata["maxzoom"]); err == nil {
+		m.maxZoom = zoom
+	}
+	for _, field := range strings.Split(metadata["bounds"], ",") {
+		value, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil {
+			m.bounds = nil
+			break
+		}
+		m.bounds = append(m.bounds, value)
+	}
+	if len(m.bounds) != 4 {
+		m.bounds = nil
+	}
+	return m, nil
+}
+
+// tile returns the tile at z/x/y in the XYZ scheme maps use; MBTiles stores rows
+// in the TMS scheme, counted from the south
+func (m *mbtiles) tile(z int, x int, y int) ([]byte, error) {
+	if z < 0 || z > 30 {
+		return nil, ErrNoTile
+	}
+	row := (1 << z) - 1 - y
+	var data []byte
+	err := m.db.QueryRow("SELECT tile_data FROM tiles WHERE zoom_level = ? AND tile_column = ? AND tile_row = ?", z, x, row).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNoTile
+	}
+	return data, err
+}
+
+func (m *mbtiles) close() error {
+	return m.db.Close()
+}
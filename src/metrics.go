@@ -0,0 +1,110 @@
+package main
+
+import (
+	"os"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Prometheus metrics served on /metrics
+var (
+	cameraReachable = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "ddpai_camera_reachable",
+		Help: "1 if the camera answered the last connection check, 0 otherwise.",
+	})
+	cameraAuthFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "ddpai_camera_auth_failures_total",
+		Help: "Session ID requests to the camera that failed.",
+	})
+	filesListed = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ddpai_camera_files_listed",
+		Help: "Files in the last camera listing, by category.",
+	}, []string{"category"})
+	downloadedBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ddpai_downloaded_bytes_total",
+		Help: "Bytes of completed downloads, by category.",
+	}, []string{"category"})
+	downloadedFiles = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ddpai_downloaded_files_total",
+		Help: "Completed downloads, by category.",
+	}, []string{"category"})
+	downloadFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ddpai_download_failures_total",
+		Help: "Downloads that failed after all retries, by category.",
+	}, []string{"category"})
+	downloadRetries = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "ddpai_download_retries_total",
+		Help: "Download attempts after the first one.",
+	})
+	downloadDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "ddpai_download_duration_seconds",
+		Help:    "Time taken by successful downloads, by category.",
+		Buckets: prometheus.ExponentialBuckets(0.5, 2, 10), // 0.5s to about 4m
+	}, []string{"category"})
+	downloadThroughput = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "ddpai_download_throughput_bytes_per_second",
+		Help:    "Average speed of successful downloads.",
+		Buckets: prometheus.ExponentialBuckets(128*1024, 2, 10), // 128KB/s to 64MB/s
+	})
+	filesDeleted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ddpai_files_deleted_total",
+		Help: "Local files removed, by category and reason (retention, quota, timelapse or manual).",
+	}, []string{"category", "reason"})
+	lastSuccessfulSync = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "ddpai_last_successful_sync_timestamp_seconds",
+		Help: "Unix time the last sync with the camera finished without errors.",
+	})
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "ddpai_skip_cache_entries",
+		Help: "Files in the skip cache after failing with EOF.",
+	}, func() float64 {
+		failedDownloadsMu.Lock()
+		defer failedDownloadsMu.Unlock()
+		pruneSkipCache()
+		return float64(len(failedDownloads))
+	})
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "ddpai_storage_used_bytes",
+		Help: "Bytes of the downloaded files on disk, from the catalog.",
+	}, func() float64 {
+		return float64(fileCatalog.usedBytes())
+	})
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "ddpai_storage_free_bytes",
+		Help: "Free bytes on the storage volume.",
+	}, func() float64 {
+		free, err := diskFree(cfg.StoragePath)
+		if err != nil {
+			return -1
+		}
+		return float64(free)
+	})
+)
+
+// observeDownload counts a completed download and its speed
+func observeDownload(f File, path string, took time.Duration) {
+	label := string(fileCategory(f.kind, f.name))
+	downloadedFiles.WithLabelValues(label).Inc()
+	downloadDuration.WithLabelValues(label).Observe(took.Seconds())
+	info, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+	downloadedBytes.WithLabelValues(label).Add(float64(info.Size()))
+	if took > 0 {
+		downloadThroughput.Observe(float64(info.Size()) / took.Seconds())
+	}
+}
+
+// observeListing sets the listed file counts of the categories a camera list holds
+func observeListing(list FileList, categories ...category) {
+	counts := map[category]int{}
+	for _, file := range list {
+		counts[fileCategory(file.kind, file.name)]++
+	}
+	for _, c := range categories {
+		filesListed.WithLabelValues(string(c)).Set(float64(counts[c]))
+	}
+}
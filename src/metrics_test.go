@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metricValue scrapes /metrics and returns the value of the series, e.g.
+// ddpai_camera_files_listed{category="event"}; -1 when it is not there
+func metricValue(t *testing.T, series string) float64 {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	promhttp.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	scanner := bufio.NewScanner(rec.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if value, found := strings.CutPrefix(line, series+" "); found {
+			v, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				t.Fatalf("%s: %v", line, err)
+			}
+			return v
+		}
+	}
+	return -1
+}
+
+func TestMetricsListingAndDeletes(t *testing.T) {
+	newTestCatalog(t)
+	now := time.Now().In(cameraTZ)
+	stamp := now.Format("20060102150405")
+	observeListing(FileList{
+		{kind: kindRecording, name: stamp + "_0060.mp4"},
+		{kind: kindRecording, name: stamp + "_0061.mp4"},
+		{kind: kindRecording, name: stamp + "_0060_T.mp4"},
+	}, categoryContinuous, categoryTimelapse)
+	if got := metricValue(t, `ddpai_camera_files_listed{category="continuous"}`); got != 2 {
+		t.Errorf("continuous listed %v, want 2", got)
+	}
+	if got := metricValue(t, `ddpai_camera_files_listed{category="timelapse"}`); got != 1 {
+		t.Errorf("timelapse listed %v, want 1", got)
+	}
+
+	series := `ddpai_files_deleted_total{category="gps",reason="manual"}`
+	before := metricValue(t, series)
+	if before < 0 {
+		before = 0
+	}
+	publishDeleted(fileRecord{Name: stamp + "_0060.git", Kind: kindGPS}, "manual")
+	if got := metricValue(t, series); got != before+1 {
+		t.Errorf("deleted %v, want %v", got, before+1)
+	}
+}
+
+func TestMetricsStorageAndSkipCache(t *testing.T) {
+	newTestCatalog(t)
+	dir := t.TempDir()
+	addStoredFile(t, dir, "20230601120000_0060.mp4", kindRecording, 3000, nil)
+	addStoredFile(t, dir, "20230601120100_0060.mp4", kindRecording, 2000, func(r *fileRecord) { r.EvictedAt = time.Now() })
+	if got := metricValue(t, "ddpai_storage_used_bytes"); got != 3000 {
+		t.Errorf("storage used %v, want 3000", got)
+	}
+
+	failedDownloadsMu.Lock()
+	saved := failedDownloads
+	failedDownloads = map[string]time.Time{
+		"http://camera/a.mp4": time.Now(),
+		"http://camera/b.mp4": time.Now().Add(-failedDownloadTTL - time.Minute),
+	}
+	failedDownloadsMu.Unlock()
+	defer func() {
+		failedDownloadsMu.Lock()
+		failedDownloads = saved
+		failedDownloadsMu.Unlock()
+	}()
+	if got := metricValue(t, "ddpai_skip_cache_entries"); got != 1 {
+		t.Errorf("skip cache entries %v, want 1", got)
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrInvalidMP4 means a downloaded clip does not have a playable MP4 layout.
+var ErrInvalidMP4 = errors.New("invalid mp4")
+
+// mp4Info is what we learn from the top-level boxes of an MP4 file
+type mp4Info struct {
+	Boxes    []string      // Top-level box types in file order
+	Duration time.Duration // From the movie header (mvhd)
+}
+
+// validationResult is the outcome of the last structural check of a clip
+type validationResult struct {
+	Name      string    `json:"name"`
+	Valid     bool      `json:"valid"`
+	Duration  float64   `json:"duration"` // Seconds
+	Error     string    `json:"error,omitempty"`
+	CheckedAt time.Time `json:"checkedAt"`
+}
+
+func isMP4(path string) bool {
+	return strings.EqualFold(filepath.Ext(strings.TrimSuffix(path, partialSuffix)), ".mp4")
+}
+
+// checkMP4 validates a downloaded clip, records the result in the catalog and
+// moves broken files to the quarantine directory.
+func checkMP4(path string, name string) error {
+	info, err := validateMP4(path)
+	fileCatalog.recordValidation(name, info.Duration, err)
+
+	if err != nil {
+		log.Warn("MP4 validation failed for ", name, ": ", err)
+		quarantineFile(path, name)
+		return err
+	}
+	log.Debug("MP4 valid ", name, " duration: ", info.Duration)
+	return nil
+}
+
+// quarantineFile keeps a broken download aside for inspection; a newer copy replaces an older one
+func quarantineFile(path string, name string) {
+	dir := filepath.Join(cfg.StoragePath, "quarantine")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		log.Warn("Cannot create quarantine directory: ", err)
+		removePartialFile(path)
+		return
+	}
+	dest := filepath.Join(dir, name)
+	if err := os.Rename(path, dest); err != nil {
+		log.Warn("Failed to quarantine ", path, ": ", err)
+		removePartialFile(path)
+		return
+	}
+	// Age the copy from when it was quarantined, not from the camera time
+	now := time.Now()
+	if err := os.Chtimes(dest, now, now); err != nil {
+		log.Warn(err)
+	}
+	log.Info("Quarantined ", name, " to ", dest)
+}
+
+// pruneQuarantine removes quarantined files older than QUARANTINE_HISTORY
+func pruneQuarantine(storagePath string) {
+	dir := filepath.Join(storagePath, "quarantine")
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, f := range files {
+		info, err := f.Info()
+		if err != nil || f.IsDir() || time.Since(info.ModTime()) < cfg.QuarantineLimit {
+			continue
+		}
+		log.Debug("Retention: removing quarantined file ", f.Name())
+		deleteFile(filepath.Join(dir, f.Name()))
+	}
+}
+
+// listValidationResults returns the validations recorded in the catalog, most recent first
+func listValidationResults() []validationResult {
+	results := []validationResult{}
+	for _, record := range fileCatalog.list() {
+		if record.Validation == "" {
+			continue
+		}
+		results = append(results, validationResult{
+			Name:      record.Name,
+			Valid:     record.Validation == validationValid,
+			Duration:  record.Duration,
+			Error:     record.ValidationError,
+			CheckedAt: record.ValidatedAt,
+		})
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].CheckedAt.After(results[j].CheckedAt) })
+	return results
+}
+
+// validateMP4 checks for an ftyp box first, a moov box with a non-zero
+// duration and an mdat box, with no box running past the end of the file.
+func validateMP4(path string) (info mp4Info, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return info, err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return info, err
+	}
+
+	var hasMoov, hasMdat bool
+	var offset int64
+	for offset < stat.Size() {
+		boxType, headerSize, boxSize, err := readBoxHeader(f, offset, stat.Size())
+		if err != nil {
+			return info, err
+		}
+		info.Boxes = append(info.Boxes, boxType)
+		switch boxType {
+		case "moov":
+			hasMoov = true
+			info.Duration, err = readMovieDuration(f, offset+headerSize, offset+boxSize)
+			if err != nil {
+				return info, err
+			}
+		case "mdat":
+			hasMdat = true
+		}
+		offset += boxSize
+	}
+
+	switch {
+	case len(info.Boxes) == 0 || info.Boxes[0] != "ftyp":
+		return info, fmt.Errorf("%w: file does not start with ftyp", ErrInvalidMP4)
+	case !hasMoov:
+		return info, fmt.Errorf("%w: no moov box", ErrInvalidMP4)
+	case !hasMdat:
+		return info, fmt.Errorf("%w: no mdat box", ErrInvalidMP4)
+	case info.Duration <= 0:
+		return info, fmt.Errorf("%w: zero duration", ErrInvalidMP4)
+	}
+	return info, nil
+}
+
+// readBoxHeader reads the box at offset and returns its type, header size and total size
+func readBoxHeader(r io.ReaderAt, offset int64, end int64) (boxType string, headerSize int64, boxSize int64, err error) {
+	var header [16]byte
+	if _, err := r.ReadAt(header[:8], offset); err != nil {
+		return "", 0, 0, fmt.Errorf("%w: truncated box header at %d", ErrInvalidMP4, offset)
+	}
+	boxType = string(header[4:8])
+	headerSize = 8
+	boxSize = int64(binary.BigEndian.Uint32(header[0:4]))
+	switch boxSize {
+	case 0: // Box extends to the end of the file
+		boxSize = end - offset
+	case 1: // 64-bit size follows the type
+		if _, err := r.ReadAt(header[8:16], offset+8); err != nil {
+			return "", 0, 0, fmt.Errorf("%w: truncated %s header", ErrInvalidMP4, boxType)
+		}
+		headerSize = 16
+		boxSize = int64(binary.BigEndian.Uint64(header[8:16]))
+	}
+	if boxSize < headerSize {
+		return "", 0, 0, fmt.Errorf("%w: bad %s box size %d", ErrInvalidMP4, boxType, boxSize)
+	}
+	if offset+boxSize > end {
+		return "", 0, 0, fmt.Errorf("%w: %s box runs past the end of the file", ErrInvalidMP4, boxType)
+	}
+	return boxType, headerSize, boxSize, nil
+}
+
+// readMovieDuration finds the mvhd box inside moov and converts its duration using the timescale
+func readMovieDuration(r io.ReaderAt, offset int64, end int64) (time.Duration, error) {
+	for offset < end {
+		boxType, headerSize, boxSize, err := readBoxHeader(r, offset, end)
+		if err != nil {
+			return 0, err
+		}
+		if boxType != "mvhd" {
+			offset += boxSize
+			continue
+		}
+		// version(1) flags(3), then creation/modification times, timescale and duration;
+		// version 1 uses 64-bit times and duration
+		var body [32]byte
+		n, _ := r.ReadAt(body[:], offset+headerSize)
+		if int64(n) > boxSize-headerSize {
+			n = int(boxSize - headerSize) // Don't read into the next box
+		}
+		var timescale uint32
+		var duration uint64
+		if body[0] == 1 {
+			if n < 32 {
+				return 0, fmt.Errorf("%w: truncated mvhd", ErrInvalidMP4)
+			}
+			timescale = binary.BigEndian.Uint32(body[20:24])
+			duration = binary.BigEndian.Uint64(body[24:32])
+		} else {
+			if n < 20 {
+				return 0, fmt.Errorf("%w: truncated mvhd", ErrInvalidMP4)
+			}
+			timescale = binary.BigEndian.Uint32(body[12:16])
+			duration = uint64(binary.BigEndian.Uint32(body[16:20]))
+		}
+		if timescale == 0 {
+			return 0, fmt.Errorf("%w: zero timescale", ErrInvalidMP4)
+		}
+		return time.Duration(float64(duration) / float64(timescale) * float64(time.Second)), nil
+	}
+	return 0, fmt.Errorf("%w: moov has no mvhd", ErrInvalidMP4)
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func mp4Box(boxType string, body ...[]byte) []byte {
+	b := make([]byte, 8)
+	copy(b[4:], boxType)
+	for _, part := range body {
+		b = append(b, part...)
+	}
+	binary.BigEndian.PutUint32(b, uint32(len(b)))
+	return b
+}
+
+// mvhdV0 is a version 0 movie header
+func mvhdV0(timescale uint32, duration uint32) []byte {
+	body := make([]byte, 100)
+	binary.BigEndian.PutUint32(body[12:], timescale)
+	binary.BigEndian.PutUint32(body[16:], duration)
+	return mp4Box("mvhd", body)
+}
+
+// mvhdV1 is a version 1 movie header with 64-bit times and duration
+func mvhdV1(timescale uint32, duration uint64) []byte {
+	body := make([]byte, 112)
+	body[0] = 1
+	binary.BigEndian.PutUint32(body[20:], timescale)
+	binary.BigEndian.PutUint64(body[24:], duration)
+	return mp4Box("mvhd", body)
+}
+
+func writeMP4(t *testing.T, boxes ...[]byte) string {
+	t.Helper()
+	var data []byte
+	for _, box := range boxes {
+		data = append(data, box...)
+	}
+	path := filepath.Join(t.TempDir(), "clip.mp4")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestValidateMP4(t *testing.T) {
+	ftyp := mp4Box("ftyp", []byte("isom\x00\x00\x02\x00isomavc1"))
+	mdat := mp4Box("mdat", make([]byte, 64))
+	// mdat with a 64-bit size
+	largeMdat := make([]byte, 16+64)
+	binary.BigEndian.PutUint32(largeMdat, 1)
+	copy(largeMdat[4:], "mdat")
+	binary.BigEndian.PutUint64(largeMdat[8:], uint64(len(largeMdat)))
+	// mdat running to the end of the file
+	openMdat := append([]byte{0, 0, 0, 0, 'm', 'd', 'a', 't'}, make([]byte, 64)...)
+	// mdat claiming more bytes than the file holds, as left by a cut-off transfer
+	truncatedMdat := mp4Box("mdat", make([]byte, 64))[:40]
+
+	tests := []struct {
+		name     string
+		boxes    [][]byte
+		duration time.Duration
+		boxTypes []string
+		err      string
+	}{
+		{
+			name:     "valid",
+			boxes:    [][]byte{ftyp, mp4Box("moov", mvhdV0(1000, 60000)), mdat},
+			duration: time.Minute,
+			boxTypes: []string{"ftyp", "moov", "mdat"},
+		},
+		{
+			name:     "mdat before moov",
+			boxes:    [][]byte{ftyp, mdat, mp4Box("moov", mp4Box("trak"), mvhdV0(90000, 900000))},
+			duration: 10 * time.Second,
+			boxTypes: []string{"ftyp", "mdat", "moov"},
+		},
+		{
+			name:     "version 1 mvhd",
+			boxes:    [][]byte{ftyp, mp4Box("moov", mvhdV1(600, 600*90)), mdat},
+			duration: 90 * time.Second,
+			boxTypes: []string{"ftyp", "moov", "mdat"},
+		},
+		{
+			name:     "64-bit box size",
+			boxes:    [][]byte{ftyp, mp4Box("moov", mvhdV0(1000, 1000)), largeMdat},
+			duration: time.Second,
+			boxTypes: []string{"ftyp", "moov", "mdat"},
+		},
+		{
+			name:     "box to end of file",
+			boxes:    [][]byte{ftyp, mp4Box("moov", mvhdV0(1000, 1000)), openMdat},
+			duration: time.Second,
+			boxTypes: []string{"ftyp", "moov", "mdat"},
+		},
+		{
+			name:  "empty file",
+			boxes: nil,
+			err:   "file does not start with ftyp",
+		},
+		{
+			name:  "no ftyp",
+			boxes: [][]byte{mp4Box("moov", mvhdV0(1000, 1000)), mdat},
+			err:   "file does not start with ftyp",
+		},
+		{
+			name:  "no moov",
+			boxes: [][]byte{ftyp, mp4Box("free", make([]byte, 16)), mdat},
+			err:   "no moov box",
+		},
+		{
+			name:  "no mdat",
+			boxes: [][]byte{ftyp, mp4Box("moov", mvhdV0(1000, 1000))},
+			err:   "no mdat box",
+		},
+		{
+			name:  "zero duration",
+			boxes: [][]byte{ftyp, mp4Box("moov", mvhdV0(1000, 0)), mdat},
+			err:   "zero duration",
+		},
+		{
+			name:  "zero timescale",
+			boxes: [][]byte{ftyp, mp4Box("moov", mvhdV0(0, 1000)), mdat},
+			err:   "zero timescale",
+		},
+		{
+			name:  "moov without mvhd",
+			boxes: [][]byte{ftyp, mp4Box("moov", mp4Box("trak")), mdat},
+			err:   "moov has no mvhd",
+		},
+		{
+			name:  "truncated mvhd",
+			boxes: [][]byte{ftyp, mp4Box("moov", mp4Box("mvhd", make([]byte, 8))), mdat},
+			err:   "truncated mvhd",
+		},
+		{
+			name:  "cut off transfer",
+			boxes: [][]byte{ftyp, mp4Box("moov", mvhdV0(1000, 1000)), truncatedMdat},
+			err:   "mdat box runs past the end of the file",
+		},
+		{
+			name:  "truncated box header",
+			boxes: [][]byte{ftyp, mp4Box("moov", mvhdV0(1000, 1000)), mdat, []byte{0, 0, 0}},
+			err:   "truncated box header",
+		},
+		{
+			name:  "box smaller than its header",
+			boxes: [][]byte{ftyp, {0, 0, 0, 4, 'f', 'r', 'e', 'e'}},
+			err:   "bad free box size 4",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info, err := validateMP4(writeMP4(t, tt.boxes...))
+			if tt.err != "" {
+				if !errors.Is(err, ErrInvalidMP4) || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Duration != tt.duration {
+				t.Errorf("duration %v, want %v", info.Duration, tt.duration)
+			}
+			if !reflect.DeepEqual(info.Boxes, tt.boxTypes) {
+				t.Errorf("boxes %v, want %v", info.Boxes, tt.boxTypes)
+			}
+		})
+	}
+}
+
+func TestIsMP4(t *testing.T) {
+	for path, want := range map[string]bool{
+		"recordings/20230101120000_0060.mp4":         true,
+		"events/20230101120000_0010_E.MP4":           true,
+		"recordings/20230101120000_0060.mp4.partial": true,
+		"events/20230101120000_0010_E.jpg":           false,
+		"recordings/20230101120000_0060.git.partial": false,
+	} {
+		if got := isMP4(path); got != want {
+			t.Errorf("isMP4(%q) = %v, want %v", path, got, want)
+		}
+	}
+}
+
+func TestPruneQuarantine(t *testing.T) {
+	dir := t.TempDir()
+	saved := cfg.QuarantineLimit
+	cfg.QuarantineLimit = time.Hour
+	defer func() { cfg.QuarantineLimit = saved }()
+
+	quarantine := filepath.Join(dir, "quarantine")
+	os.MkdirAll(quarantine, 0700)
+	for name, age := range map[string]time.Duration{"old.mp4": 2 * time.Hour, "new.mp4": time.Minute} {
+		path := filepath.Join(quarantine, name)
+		os.WriteFile(path, []byte("broken"), 0600)
+		stamp := time.Now().Add(-age)
+		os.Chtimes(path, stamp, stamp)
+	}
+
+	pruneQuarantine(dir)
+	if _, err := os.Stat(filepath.Join(quarantine, "old.mp4")); !os.IsNotExist(err) {
+		t.Error("old quarantined file kept")
+	}
+	if _, err := os.Stat(filepath.Join(quarantine, "new.mp4")); err != nil {
+		t.Error("recent quarantined file removed: ", err)
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	log "github.com/sirupsen/logrus"
+)
+
+// Pin reason used for recordings protected because of a nearby event
+const autoPinReason = "event"
+
+// pin protects a file from every retention pass
+func pin(name string, reason string) (fileRecord, error) {
+	err := fileCatalog.update(name, func(r *fileRecord) {
+		// Files can be pinned before they are downloaded
+		if r.CameraTime.IsZero() {
+			r.CameraTime, _ = fileNameToDate(name)
+		}
+		if !r.Pinned {
+			r.PinnedAt = time.Now()
+		}
+		r.Pinned = true
+		r.PinReason = reason
+	})
+	if err != nil {
+		return fileRecord{}, err
+	}
+	record, _ := fileCatalog.get(name)
+	return record, nil
+}
+
+func unpin(name string) (fileRecord, error) {
+	err := fileCatalog.update(name, func(r *fileRecord) {
+		r.Pinned = false
+		r.PinReason = ""
+		r.PinnedAt = time.Time{}
+	})
+	if err != nil {
+		return fileRecord{}, err
+	}
+	record, _ := fileCatalog.get(name)
+	return record, nil
+}
+
+// Length assumed for recordings until their MP4 duration is known
+const defaultClipLength = time.Minute
+
+// Longest recording and the furthest an event's start or end lies from the time in its
+// name; bounds the catalog scan for the files around an event
+const (
+	maxClipLength  = 5 * time.Minute
+	maxEventLength = 5 * time.Minute
+)
+
+// inEventContext tells whether a clip overlaps the PIN_EVENT_WINDOW before an event starts or after it ends
+func inEventContext(eventStart, eventEnd, clipStart, clipEnd time.Time) bool {
+	if cfg.PinEventWindow <= 0 {
+		return false
+	}
+	return clipEnd.After(eventStart.Add(-cfg.PinEventWindow)) && clipStart.Before(eventEnd.Add(cfg.PinEventWindow))
+}
+
+// eventSpan is when an event starts and ends, falling back to the time in its file name
+func eventSpan(start, end, date time.Time) (time.Time, time.Time) {
+	if start.IsZero() {
+		start = date
+	}
+	if end.Before(start) {
+		end = start
+	}
+	return start, end
+}
+
+func (r fileRecord) eventSpan() (time.Time, time.Time) {
+	return eventSpan(r.EventStart, r.EventEnd, r.CameraTime)
+}
+
+// clipSpan is the time covered by a recording or GPS file
+func (r fileRecord) clipSpan() (time.Time, time.Time) {
+	length := defaultClipLength
+	if r.Duration > 0 {
+		length = time.Duration(r.Duration * float64(time.Second))
+	}
+	return r.CameraTime, r.CameraTime.Add(length)
+}
+
+// autoPin links events with the recordings and GPS files around them and pins those.
+// Called for every downloaded file, so it works whichever of the two arrives first.
+func autoPin(record fileRecord) {
+	if cfg.PinEventWindow <= 0 {
+		return
+	}
+	switch record.Kind {
+	case kindEvent:
+		eventStart, eventEnd := record.eventSpan()
+		// Clips are named after their start, so the ones overlapping the window start before it ends
+		from, to := eventStart.Add(-cfg.PinEventWindow-maxClipLength), eventEnd.Add(cfg.PinEventWindow)
+		for _, other := range fileCatalog.listBetween(from, to) {
+			if other.Kind != kindRecording && other.Kind != kindGPS {
+				continue
+			}
+			clipStart, clipEnd := other.clipSpan()
+			if inEventContext(eventStart, eventEnd, clipStart, clipEnd) {
+				linkEventContext(record.Name, other.Name)
+			}
+		}
+	case kindRecording, kindGPS:
+		clipStart, clipEnd := record.clipSpan()
+		from, to := clipStart.Add(-cfg.PinEventWindow-maxEventLength), clipEnd.Add(cfg.PinEventWindow+maxEventLength)
+		for _, other := range fileCatalog.listBetween(from, to) {
+			if other.Kind != kindEvent {
+				continue
+			}
+			eventStart, eventEnd := other.eventSpan()
+			if inEventContext(eventStart, eventEnd, clipStart, clipEnd) {
+				linkEventContext(other.Name, record.Name)
+			}
+		}
+	}
+}
+
+// linkEventContext records that a recording or GPS file is context for an event and pins it
+func linkEventContext(event string, name string) {
+	err := fileCatalog.update(event, func(r *fileRecord) {
+		r.Context = appendUnique(r.Context, name)
+	})
+	if err != nil {
+		log.Warn("Cannot link ", name, " to event ", event, ": ", err)
+	}
+	record, _ := fileCatalog.get(name)
+	err = fileCatalog.update(name, func(r *fileRecord) {
+		r.Events = appendUnique(r.Events, event)
+	})
+	if err != nil {
+		log.Warn("Cannot link event ", event, " to ", name, ": ", err)
+	}
+	if record.Pinned {
+		return
+	}
+	if _, err := pin(name, autoPinReason); err != nil {
+		log.Warn("Cannot pin ", name, " for event ", event, ": ", err)
+		return
+	}
+	log.Info("Pinned ", name, " around event ", event)
+}
+
+// unlinkEventContext drops an event that left the catalog from the files around it.
+// Files pinned only because of their events are unpinned once none is left; other pins stay.
+func unlinkEventContext(event fileRecord) {
+	for _, name := range event.Context {
+		if _, found := fileCatalog.get(name); !found {
+			continue
+		}
+		unpinned := false
+		err := fileCatalog.update(name, func(r *fileRecord) {
+			r.Events = removeValue(r.Events, event.Name)
+			if len(r.Events) == 0 && r.Pinned && r.PinReason == autoPinReason {
+				r.Pinned = false
+				r.PinReason = ""
+				r.PinnedAt = time.Time{}
+				unpinned = true
+			}
+		})
+		if err != nil {
+			log.Warn("Cannot unlink event ", event.Name, " from ", name, ": ", err)
+			continue
+		}
+		if unpinned {
+			log.Info("Unpinned ", name, ", event ", event.Name, " is gone")
+		}
+	}
+}
+
+func appendUnique(list []string, value string) []string {
+	for _, v := range list {
+		if v == value {
+			return list
+		}
+	}
+	return append(list, value)
+}
+
+func removeValue(list []string, value string) []string {
+	kept := list[:0]
+	for _, v := range list {
+		if v != value {
+			kept = append(kept, v)
+		}
+	}
+	return kept
+}
+
+// pinHandler pins a file; the optional JSON body {"reason": "..."} is stored with it
+func pinHandler(c echo.Context) error {
+	name := c.Param("name")
+	if _, err := fileNameToDate(name); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	var body struct {
+		Reason string `json:"reason"`
+	}
+	if c.Request().ContentLength > 0 {
+		if err := c.Bind(&body); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid body"})
+		}
+	}
+	if body.Reason == "" {
+		body.Reason = "manual"
+	}
+	record, err := pin(name, body.Reason)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	log.Info("Pinned ", name, ": ", body.Reason)
+	return c.JSON(http.StatusOK, record)
+}
+
+func unpinHandler(c echo.Context) error {
+	name := c.Param("name")
+	if _, found := fileCatalog.get(name); !found {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "unknown file"})
+	}
+	record, err := unpin(name)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	log.Info("Unpinned ", name)
+	return c.JSON(http.StatusOK, record)
+}
+
+// pinsHandler lists the pinned files
+func pinsHandler(c echo.Context) error {
+	pinned := []fileRecord{}
+	for _, record := range fileCatalog.list() {
+		if record.Pinned {
+			pinned = append(pinned, record)
+		}
+	}
+	return c.JSON(http.StatusOK, pinned)
+}
+
+// isEventContext tells whether a recording or GPS file from the camera lists is around one of the events
+func isEventContext(file File, eventList FileList) bool {
+	if file.kind != kindRecording && file.kind != kindGPS {
+		return false
+	}
+	for _, event := range eventList {
+		if event.kind != kindEvent {
+			continue
+		}
+		start, end := eventSpan(event.start, event.end, event.date)
+		if inEventContext(start, end, file.date, file.date.Add(defaultClipLength)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestAutoPin(t *testing.T) {
+	newTestCatalog(t)
+	saved := cfg
+	defer func() { cfg = saved }()
+	cfg.PinEventWindow = 2 * time.Minute
+
+	addTestRecord(t, "20230601115500_0060.mp4", kindRecording, nil) // Ends before the window
+	addTestRecord(t, "20230601115800_0060.mp4", kindRecording, nil)
+	addTestRecord(t, "20230601120230_0060.git", kindGPS, nil)
+	addTestRecord(t, "20230601120600_0060.mp4", kindRecording, nil) // Starts after the window
+	addTestRecord(t, "20230601120000_0010_E.mp4", kindEvent, func(r *fileRecord) {
+		r.EventStart = time.Date(2023, 6, 1, 12, 0, 0, 0, cameraTZ)
+		r.EventEnd = r.EventStart.Add(time.Minute)
+	})
+	event, _ := fileCatalog.get("20230601120000_0010_E.mp4")
+	autoPin(event)
+
+	// A clip arriving after its event is linked as well
+	addTestRecord(t, "20230601120200_0060.mp4", kindRecording, nil)
+	clip, _ := fileCatalog.get("20230601120200_0060.mp4")
+	autoPin(clip)
+
+	for name, want := range map[string]bool{
+		"20230601115500_0060.mp4": false,
+		"20230601115800_0060.mp4": true,
+		"20230601120200_0060.mp4": true,
+		"20230601120230_0060.git": true,
+		"20230601120600_0060.mp4": false,
+	} {
+		if record, _ := fileCatalog.get(name); record.Pinned != want {
+			t.Errorf("%s pinned %v, want %v", name, record.Pinned, want)
+		}
+	}
+}
+
+func TestPinHandlers(t *testing.T) {
+	newTestCatalog(t)
+	addTestRecord(t, "20230601120000_0060.mp4", kindRecording, nil)
+	addTestRecord(t, "20230601120100_0060.mp4", kindRecording, nil)
+
+	if rec := serveAPI(http.MethodPost, "/api/files/:name/pin", pinHandler, "/api/files/notes.txt/pin", nil); rec.Code != http.StatusBadRequest {
+		t.Errorf("bad name: status %d", rec.Code)
+	}
+	if rec := serveAPI(http.MethodPost, "/api/files/:name/pin", pinHandler, "/api/files/20230601120000_0060.mp4/pin", nil); rec.Code != http.StatusOK {
+		t.Fatalf("pin: status %d: %s", rec.Code, rec.Body)
+	}
+	if r, _ := fileCatalog.get("20230601120000_0060.mp4"); !r.Pinned || r.PinReason != "manual" {
+		t.Errorf("pinned %v reason %q, want the manual reason", r.Pinned, r.PinReason)
+	}
+
+	e := echo.New()
+	e.POST("/api/files/:name/pin", pinHandler)
+	req := httptest.NewRequest(http.MethodPost, "/api/files/20230601120100_0060.mp4/pin", strings.NewReader(`{"reason":"crash"}`))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("pin with reason: status %d: %s", rec.Code, rec.Body)
+	}
+	if r, _ := fileCatalog.get("20230601120100_0060.mp4"); r.PinReason != "crash" {
+		t.Errorf("reason %q, want crash", r.PinReason)
+	}
+
+	rec = serveAPI(http.MethodGet, "/api/pins", pinsHandler, "/api/pins", nil)
+	var pinned []fileRecord
+	if err := json.Unmarshal(rec.Body.Bytes(), &pinned); err != nil {
+		t.Fatal(err)
+	}
+	if len(pinned) != 2 {
+		t.Errorf("%d pinned files listed, want 2", len(pinned))
+	}
+
+	if rec := serveAPI(http.MethodDelete, "/api/files/:name/pin", unpinHandler, "/api/files/20230601130000_0060.mp4/pin", nil); rec.Code != http.StatusNotFound {
+		t.Errorf("unpin unknown file: status %d", rec.Code)
+	}
+	if rec := serveAPI(http.MethodDelete, "/api/files/:name/pin", unpinHandler, "/api/files/20230601120000_0060.mp4/pin", nil); rec.Code != http.StatusOK {
+		t.Fatalf("unpin: status %d: %s", rec.Code, rec.Body)
+	}
+	if r, _ := fileCatalog.get("20230601120000_0060.mp4"); r.Pinned {
+		t.Error("still pinned after unpin")
+	}
+}
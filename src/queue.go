@@ -0,0 +1,141 @@
+package main
+
+import (
+	"container/heap"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// downloadClass groups queued files for prioritisation
+type downloadClass string
+
+const (
+	classEvent    downloadClass = "events"   // Event videos and thumbnails
+	classContext  downloadClass = "context"  // Recordings and GPS files within PIN_EVENT_WINDOW of an event
+	classRecent   downloadClass = "recent"   // Recordings newer than RECENT_WINDOW
+	classGPS      downloadClass = "gps"      // GPS files
+	classBackfill downloadClass = "backfill" // Older recordings
+)
+
+// Order used when DOWNLOAD_PRIORITY leaves a class out
+var defaultPriority = []downloadClass{classEvent, classContext, classRecent, classGPS, classBackfill}
+
+// parsePriority turns the DOWNLOAD_PRIORITY list into a rank per class, lowest first.
+// Unknown names are ignored and missing classes are ranked last in the default order.
+func parsePriority(names []string) map[downloadClass]int {
+	ranks := map[downloadClass]int{}
+	for _, name := range names {
+		class := downloadClass(strings.ToLower(strings.TrimSpace(name)))
+		if _, dup := ranks[class]; dup {
+			continue
+		}
+		known := false
+		for _, c := range defaultPriority {
+			known = known || c == class
+		}
+		if !known {
+			log.Warn("Ignoring unknown download priority class: ", name)
+			continue
+		}
+		ranks[class] = len(ranks)
+	}
+	for _, class := range defaultPriority {
+		if _, ok := ranks[class]; !ok {
+			ranks[class] = len(ranks)
+		}
+	}
+	return ranks
+}
+
+// recordingClass tells recent recordings apart from the backfill
+func recordingClass(date time.Time, recentWindow time.Duration) downloadClass {
+	if date.Before(time.Now().Add(-recentWindow)) {
+		return classBackfill
+	}
+	return classRecent
+}
+
+// downloadQueue hands out jobs by class rank, newest first within a class.
+// Each destination is only queued once per sync. Not safe for concurrent use.
+type downloadQueue struct {
+	ranks  map[downloadClass]int
+	jobs   jobHeap
+	queued map[string]bool
+}
+
+func newDownloadQueue(ranks map[downloadClass]int) *downloadQueue {
+	return &downloadQueue{ranks: ranks, queued: map[string]bool{}}
+}
+
+// push adds a job; returns false if its destination was already queued
+func (q *downloadQueue) push(job downloadJob) bool {
+	if q.queued[job.path] {
+		return false
+	}
+	q.queued[job.path] = true
+	heap.Push(&q.jobs, rankedJob{job: job, rank: q.ranks[job.class], seq: len(q.queued)})
+	return true
+}
+
+// promote moves the queued jobs matching fn into class, if it ranks higher than their own
+func (q *downloadQueue) promote(class downloadClass, fn func(downloadJob) bool) {
+	rank := q.ranks[class]
+	for i := range q.jobs {
+		if q.jobs[i].rank > rank && fn(q.jobs[i].job) {
+			q.jobs[i].job.class = class
+			q.jobs[i].rank = rank
+		}
+	}
+	heap.Init(&q.jobs)
+}
+
+func (q *downloadQueue) pop() downloadJob {
+	return heap.Pop(&q.jobs).(rankedJob).job
+}
+
+func (q *downloadQueue) len() int {
+	return q.jobs.Len()
+}
+
+// counts tells how many jobs of each class are waiting
+func (q *downloadQueue) counts() map[downloadClass]int {
+	counts := map[downloadClass]int{}
+	for _, ranked := range q.jobs {
+		counts[ranked.job.class]++
+	}
+	return counts
+}
+
+type rankedJob struct {
+	job  downloadJob
+	rank int
+	seq  int // Keeps listing order for files with the same timestamp
+}
+
+type jobHeap []rankedJob
+
+func (h jobHeap) Len() int { return len(h) }
+
+func (h jobHeap) Less(i, j int) bool {
+	if h[i].rank != h[j].rank {
+		return h[i].rank < h[j].rank
+	}
+	if !h[i].job.file.date.Equal(h[j].job.file.date) {
+		return h[i].job.file.date.After(h[j].job.file.date)
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h jobHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *jobHeap) Push(x interface{}) { *h = append(*h, x.(rankedJob)) }
+
+func (h *jobHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	*h = old[:n-1]
+	return item
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func queuedJob(name string, date time.Time, class downloadClass) downloadJob {
+	return downloadJob{file: File{name: name, date: date}, path: "/media/" + name, class: class}
+}
+
+func drain(q *downloadQueue) (names []string) {
+	for q.len() > 0 {
+		names = append(names, q.pop().file.name)
+	}
+	return names
+}
+
+func TestParsePriority(t *testing.T) {
+	tests := []struct {
+		names []string
+		want  map[downloadClass]int
+	}{
+		{
+			names: []string{"events", "context", "recent", "gps", "backfill"},
+			want:  map[downloadClass]int{classEvent: 0, classContext: 1, classRecent: 2, classGPS: 3, classBackfill: 4},
+		},
+		{
+			// Missing classes follow in the default order
+			names: []string{"gps", " Backfill "},
+			want:  map[downloadClass]int{classGPS: 0, classBackfill: 1, classEvent: 2, classContext: 3, classRecent: 4},
+		},
+		{
+			// Unknown and repeated names are ignored
+			names: []string{"recent", "bogus", "recent", "events"},
+			want:  map[downloadClass]int{classRecent: 0, classEvent: 1, classContext: 2, classGPS: 3, classBackfill: 4},
+		},
+	}
+	for _, tt := range tests {
+		if got := parsePriority(tt.names); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parsePriority(%q) = %v, want %v", tt.names, got, tt.want)
+		}
+	}
+}
+
+func TestRecordingClass(t *testing.T) {
+	if got := recordingClass(time.Now().Add(-time.Hour), 2*time.Hour); got != classRecent {
+		t.Errorf("hour old recording: got %s, want %s", got, classRecent)
+	}
+	if got := recordingClass(time.Now().Add(-3*time.Hour), 2*time.Hour); got != classBackfill {
+		t.Errorf("3 hour old recording: got %s, want %s", got, classBackfill)
+	}
+}
+
+func TestDownloadQueueOrder(t *testing.T) {
+	base := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	q := newDownloadQueue(parsePriority([]string{"events", "context", "recent", "gps", "backfill"}))
+	q.push(queuedJob("old", base.Add(-48*time.Hour), classBackfill))
+	q.push(queuedJob("gps", base, classGPS))
+	q.push(queuedJob("recent-1", base.Add(-time.Minute), classRecent))
+	q.push(queuedJob("recent-2", base, classRecent))
+	q.push(queuedJob("event-1", base.Add(-time.Hour), classEvent))
+	q.push(queuedJob("event-2", base.Add(-time.Hour), classEvent)) // Same time: listing order
+	q.push(queuedJob("event-3", base, classEvent))
+
+	want := []string{"event-3", "event-1", "event-2", "recent-2", "recent-1", "gps", "old"}
+	if got := drain(q); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestDownloadQueueFollowsPriority(t *testing.T) {
+	base := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	q := newDownloadQueue(parsePriority([]string{"gps", "backfill"}))
+	q.push(queuedJob("event", base, classEvent))
+	q.push(queuedJob("old", base.Add(-48*time.Hour), classBackfill))
+	q.push(queuedJob("gps", base.Add(-72*time.Hour), classGPS))
+
+	want := []string{"gps", "old", "event"}
+	if got := drain(q); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestDownloadQueuePushOnce(t *testing.T) {
+	q := newDownloadQueue(parsePriority(nil))
+	job := queuedJob("clip", time.Now(), classRecent)
+	if !q.push(job) {
+		t.Fatal("first push refused")
+	}
+	if q.push(job) {
+		t.Error("same destination queued twice")
+	}
+	q.pop()
+	if q.push(job) {
+		t.Error("destination queued again after it was handed out")
+	}
+}
+
+func TestDownloadQueuePromote(t *testing.T) {
+	base := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	q := newDownloadQueue(parsePriority(nil))
+	q.push(queuedJob("recent", base, classRecent))
+	q.push(queuedJob("around-event", base.Add(-48*time.Hour), classBackfill))
+	q.push(queuedJob("event", base.Add(-48*time.Hour), classEvent))
+	q.push(queuedJob("gps", base, classGPS))
+
+	isContext := func(job downloadJob) bool { return job.file.name == "around-event" || job.file.name == "event" }
+	q.promote(classContext, isContext)
+	if got := q.counts(); got[classContext] != 1 || got[classEvent] != 1 || got[classBackfill] != 0 {
+		t.Errorf("counts after promote: %v", got)
+	}
+	// Events outrank context and keep their class
+	want := []string{"event", "around-event", "recent", "gps"}
+	if got := drain(q); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrQuota means a download was skipped because the storage limits could not be met.
+var ErrQuota = errors.New("skip: storage quota exceeded")
+
+// Space promised to downloads in progress, so parallel workers don't overshoot the quota
+var (
+	quotaMu       sync.Mutex
+	reservedBytes int64
+)
+
+// parseEvictionOrder turns EVICTION_ORDER into a rank per category, lowest evicted first.
+// Categories left out, like pinned files, are never evicted.
+func parseEvictionOrder(names []string) map[category]int {
+	ranks := map[category]int{}
+	for _, name := range names {
+		c := category(strings.ToLower(strings.TrimSpace(name)))
+		switch c {
+		case categoryEvent, categoryContinuous, categoryTimelapse, categoryGPS, categoryStitched, categoryCondensed:
+			if _, dup := ranks[c]; !dup {
+				ranks[c] = len(ranks)
+			}
+		default:
+			log.Warn("Ignoring unknown eviction category: ", name)
+		}
+	}
+	return ranks
+}
+
+func quotaEnabled() bool {
+	return cfg.MaxStorageBytes > 0 || cfg.MinFreeBytes > 0
+}
+
+// reserveSpace makes room for a download of size bytes (0 if unknown) by evicting old
+// files if needed. The returned release must be called once the download finished or failed.
+func reserveSpace(name string, size int64, date time.Time) (release func(), err error) {
+	if !quotaEnabled() {
+		return func() {}, nil
+	}
+	if size < 0 {
+		size = 0
+	}
+	quotaMu.Lock()
+	defer quotaMu.Unlock()
+	if !evictFor(size, date) {
+		log.Warn("Skipping download of ", name, " (", size, " bytes): storage quota cannot be met")
+		return nil, fmt.Errorf("%w: %s", ErrQuota, name)
+	}
+	reservedBytes += size
+	return func() {
+		quotaMu.Lock()
+		reservedBytes -= size
+		quotaMu.Unlock()
+	}, nil
+}
+
+// enforceQuota evicts files until the storage is back under its limits
+func enforceQuota() {
+	if !quotaEnabled() {
+		return
+	}
+	quotaMu.Lock()
+	defer quotaMu.Unlock()
+	if !evictFor(0, time.Time{}) {
+		log.Warn("Storage is over quota and nothing else can be evicted")
+	}
+}
+
+// evictFor deletes files, in EVICTION_ORDER and oldest first, until need more bytes
+// fit within MAX_STORAGE_BYTES and MIN_FREE_BYTES. Only files older than before are
+// evicted, unless it is zero, so old backfill never pushes out newer footage. Nothing is
+// deleted and false is returned if evicting every candidate would not be enough.
+// Caller must hold quotaMu.
+func evictFor(need int64, before time.Time) bool {
+	free := int64(-1)
+	if cfg.MinFreeBytes > 0 {
+		var err error
+		if free, err = diskFree(cfg.StoragePath); err != nil {
+			log.Warn("Cannot read free disk space: ", err)
+			free = -1
+		}
+	}
+
+	over := func(used int64, free int64) bool {
+		if cfg.MaxStorageBytes > 0 && used+reservedBytes+need > cfg.MaxStorageBytes {
+			return true
+		}
+		return free >= 0 && free-reservedBytes-need < cfg.MinFreeBytes
+	}
+	// The catalog keeps a running total, so only an eviction has to read it
+	if !over(fileCatalog.usedBytes(), free) {
+		return true
+	}
+
+	var used int64
+	var candidates []fileRecord
+	for _, record := range fileCatalog.list() {
+		if !record.stored() {
+			continue
+		}
+		used += record.Size
+		if record.Pinned || (!before.IsZero() && !record.CameraTime.Before(before)) {
+			continue
+		}
+		if _, evictable := cfg.evictionRanks[record.category()]; evictable {
+			candidates = append(candidates, record)
+		}
+	}
+	if !over(used, free) {
+		return true
+	}
+	var evictable int64
+	for _, record := range candidates {
+		evictable += record.Size
+	}
+	if free >= 0 {
+		if over(used-evictable, free+evictable) {
+			return false
+		}
+	} else if over(used-evictable, free) {
+		return false
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		ri, rj := cfg.evictionRanks[candidates[i].category()], cfg.evictionRanks[candidates[j].category()]
+		if ri != rj {
+			return ri < rj
+		}
+		return candidates[i].CameraTime.Before(candidates[j].CameraTime)
+	})
+	for _, record := range candidates {
+		if !over(used, free) {
+			break
+		}
+		log.Info("Storage quota: evicting ", record.category(), " file ", record.Name, " (", record.Size, " bytes)")
+		publishDeleted(record, "quota")
+		deleteFile(record.Path)
+		removeDerivedFiles(record)
+		// Keep the record so the file is not downloaded again
+		err := fileCatalog.update(record.Name, func(r *fileRecord) {
+			r.Path = ""
+			r.EvictedAt = time.Now()
+		})
+		if err != nil {
+			log.Warn("Cannot mark ", record.Name, " as evicted in the catalog: ", err)
+		}
+		used -= record.Size
+		if free >= 0 {
+			free += record.Size
+		}
+	}
+	return !over(used, free)
+}
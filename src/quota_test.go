@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseEvictionOrder(t *testing.T) {
+	got := parseEvictionOrder([]string{"stitched", "condensed", " GPS", "bogus", "gps", "event"})
+	want := map[category]int{categoryStitched: 0, categoryCondensed: 1, categoryGPS: 2, categoryEvent: 3}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestEnforceQuotaEvictsStitchedFirst(t *testing.T) {
+	newTestCatalog(t)
+	dir := t.TempDir()
+	saved := cfg
+	defer func() { cfg = saved }()
+	cfg.MaxStorageBytes = 5000
+	cfg.MinFreeBytes = 0
+	cfg.evictionRanks = parseEvictionOrder([]string{"stitched", "continuous", "event"})
+
+	now := time.Now().In(cameraTZ)
+	stamp := func(age time.Duration) string { return now.Add(-age).Format("20060102150405") }
+	event := addStoredFile(t, dir, stamp(3*time.Hour)+"_0010_E.mp4", kindEvent, 2000, nil)
+	clip := addStoredFile(t, dir, stamp(2*time.Hour)+"_0060.mp4", kindRecording, 2000, nil)
+	stitched := addStoredFile(t, dir, stamp(time.Hour)+".mp4", kindStitched, 2000, nil)
+
+	// Stitched videos count towards the quota and go before older recordings
+	enforceQuota()
+	if _, err := os.Stat(stitched); !os.IsNotExist(err) {
+		t.Error("stitched video not evicted")
+	}
+	for _, path := range []string{event, clip} {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("%s evicted: %v", path, err)
+		}
+	}
+}
+
+// quotaTestFiles stores three 2000 byte recordings, 3, 2 and 1 hours old, under a
+// 5000 byte limit. Returns their names and paths, oldest first.
+func quotaTestFiles(t *testing.T) (names []string, paths []string) {
+	t.Helper()
+	newTestCatalog(t)
+	dir := t.TempDir()
+	saved := cfg
+	t.Cleanup(func() { cfg = saved })
+	cfg.MaxStorageBytes = 5000
+	cfg.MinFreeBytes = 0
+	cfg.evictionRanks = parseEvictionOrder([]string{"continuous"})
+
+	now := time.Now().In(cameraTZ)
+	for _, age := range []time.Duration{3 * time.Hour, 2 * time.Hour, time.Hour} {
+		name := now.Add(-age).Format("20060102150405") + "_0060.mp4"
+		names = append(names, name)
+		paths = append(paths, addStoredFile(t, dir, name, kindRecording, 2000, nil))
+	}
+	return names, paths
+}
+
+func expectOnDisk(t *testing.T, paths []string, want ...bool) {
+	t.Helper()
+	for i, path := range paths {
+		_, err := os.Stat(path)
+		if (err == nil) != want[i] {
+			t.Errorf("file %d on disk: %v, want %v", i, err == nil, want[i])
+		}
+	}
+}
+
+func TestReserveSpaceOnlyEvictsOlderFiles(t *testing.T) {
+	names, paths := quotaTestFiles(t)
+	now := time.Now()
+
+	// Backfill of a clip older than every stored file has nothing to push out
+	_, err := reserveSpace("old.mp4", 2000, now.Add(-4*time.Hour))
+	if !errors.Is(err, ErrQuota) {
+		t.Fatalf("got %v, want ErrQuota", err)
+	}
+	expectOnDisk(t, paths, true, true, true)
+
+	release, err := reserveSpace("new.mp4", 1000, now.Add(-150*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	expectOnDisk(t, paths, false, true, true)
+	if record, _ := fileCatalog.get(names[0]); record.stored() || record.EvictedAt.IsZero() {
+		t.Errorf("evicted file not marked in the catalog: %+v", record)
+	}
+}
+
+func TestReserveSpaceCountsDownloadsInProgress(t *testing.T) {
+	_, paths := quotaTestFiles(t)
+	cfg.MaxStorageBytes = 7000
+
+	// 6000 stored + 1000 in flight fits; the second download needs an eviction
+	first, err := reserveSpace("first.mp4", 1000, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectOnDisk(t, paths, true, true, true)
+	second, err := reserveSpace("second.mp4", 1000, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectOnDisk(t, paths, false, true, true)
+
+	first()
+	second()
+	quotaMu.Lock()
+	defer quotaMu.Unlock()
+	if reservedBytes != 0 {
+		t.Errorf("%d bytes still reserved after release", reservedBytes)
+	}
+}
+
+func TestReserveSpaceSkipsPinnedFiles(t *testing.T) {
+	names, paths := quotaTestFiles(t)
+	if _, err := pin(names[0], "manual"); err != nil {
+		t.Fatal(err)
+	}
+
+	release, err := reserveSpace("new.mp4", 1000, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	expectOnDisk(t, paths, true, false, true)
+}
+
+func TestReserveSpaceRefusedWhenNothingCanGo(t *testing.T) {
+	names, paths := quotaTestFiles(t)
+	pin(names[0], "manual")
+	pin(names[1], "manual")
+
+	// Evicting the one unpinned file would still leave 4000 + 2000 over the limit
+	if _, err := reserveSpace("new.mp4", 2000, time.Now()); !errors.Is(err, ErrQuota) {
+		t.Fatalf("got %v, want ErrQuota", err)
+	}
+	expectOnDisk(t, paths, true, true, true)
+
+	// Categories left out of EVICTION_ORDER are never evicted
+	unpin(names[0])
+	unpin(names[1])
+	cfg.evictionRanks = parseEvictionOrder([]string{"event"})
+	if _, err := reserveSpace("new.mp4", 1000, time.Now()); !errors.Is(err, ErrQuota) {
+		t.Fatalf("got %v, want ErrQuota", err)
+	}
+	expectOnDisk(t, paths, true, true, true)
+}
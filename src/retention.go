@@ -0,0 +1,154 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// category decides how long a file is kept
+type category string
+
+const (
+	categoryEvent      category = "event"      // Event videos and their thumbnails
+	categoryContinuous category = "continuous" // Normal driving recordings
+	categoryTimelapse  category = "timelapse"  // Parking mode/timelapse recordings
+	categoryGPS        category = "gps"        // GPS tracks
+	categoryStitched   category = "stitched"   // Trip videos and time ranges stitched from recordings
+	categoryCondensed  category = "condensed"  // Parking timelapses built from parking recordings
+)
+
+// Name suffix the camera gives parking mode/timelapse recordings, e.g. 20230101120000_0060_T.mp4
+const timelapseSuffix = "_T"
+
+// fileCategory derives the category from the list a file came from and its name
+func fileCategory(kind fileKind, name string) category {
+	switch kind {
+	case kindEvent, kindThumbnail:
+		return categoryEvent
+	case kindGPS:
+		return categoryGPS
+	case kindStitched:
+		return categoryStitched
+	case kindCondensed:
+		return categoryCondensed
+	}
+	base := strings.TrimSuffix(name, filepath.Ext(name))
+	if strings.HasSuffix(strings.ToUpper(base), timelapseSuffix) {
+		return categoryTimelapse
+	}
+	return categoryContinuous
+}
+
+func (r fileRecord) category() category {
+	return fileCategory(r.Kind, r.Name)
+}
+
+// retentionFor returns how long files of a category are kept
+func retentionFor(c category) time.Duration {
+	switch c {
+	case categoryEvent:
+		return cfg.EventHistory
+	case categoryTimelapse:
+		return cfg.TimelapseHistory
+	case categoryGPS:
+		return cfg.GpsHistory
+	case categoryStitched:
+		return cfg.StitchedHistory
+	case categoryCondensed:
+		return cfg.ParkingHistory
+	default:
+		return cfg.HistoryLimit
+	}
+}
+
+// expired tells whether a camera file is past the retention of its category
+func expired(kind fileKind, name string, date time.Time) bool {
+	return date.Before(time.Now().Add(-retentionFor(fileCategory(kind, name))))
+}
+
+// retentionStart is when the retention of a record starts: the camera time, when it
+// was made for videos stitched or condensed here, or the last download attempt for
+// files without a camera time that were never downloaded
+func (r fileRecord) retentionStart() time.Time {
+	switch {
+	case r.Kind == kindStitched || r.Kind == kindCondensed:
+		return r.DownloadedAt
+	case r.CameraTime.IsZero() && !r.downloaded():
+		return r.lastAttempt()
+	}
+	return r.CameraTime
+}
+
+// lastAttempt is the last time a download of the file failed or was skipped
+func (r fileRecord) lastAttempt() (last time.Time) {
+	if len(r.Failures) > 0 {
+		last = r.Failures[len(r.Failures)-1].At
+	}
+	if r.SkippedAt.After(last) {
+		last = r.SkippedAt
+	}
+	return last
+}
+
+// condensedExpired tells whether a parking recording that went into a timelapse is past TIMELAPSE_SOURCE_HISTORY
+func (r fileRecord) condensedExpired() bool {
+	return r.Timelapse != "" && r.CameraTime.Before(time.Now().Add(-cfg.CondensedHistory))
+}
+
+// checkHistory deletes downloaded files older than the retention of their category.
+// Parking recordings condensed into a timelapse go after TIMELAPSE_SOURCE_HISTORY;
+// their record stays until the normal retention so they are not downloaded again.
+// Removing an event releases the automatic pins of the files around it. Records of
+// files that were never downloaded, holding only failures and skips, are forgotten
+// once past the same retention.
+func checkHistory() (count int) {
+	for _, record := range fileCatalog.list() {
+		if record.Pinned {
+			continue
+		}
+		if !record.downloaded() {
+			if expired(record.Kind, record.Name, record.retentionStart()) {
+				log.Debug("Retention: forgetting ", record.Name, ", never downloaded")
+				if err := fileCatalog.remove(record.Name); err != nil {
+					log.Warn("Cannot remove ", record.Name, " from the catalog: ", err)
+				}
+			}
+			continue
+		}
+		if !expired(record.Kind, record.Name, record.retentionStart()) {
+			if record.stored() && record.condensedExpired() {
+				log.Debug("Retention: removing ", record.Name, ", condensed into ", record.Timelapse)
+				publishDeleted(record, "timelapse")
+				count++
+				deleteFile(record.Path)
+				removeDerivedFiles(record)
+				err := fileCatalog.update(record.Name, func(r *fileRecord) {
+					r.Path = ""
+					r.EvictedAt = time.Now()
+				})
+				if err != nil {
+					log.Warn("Cannot mark ", record.Name, " as removed in the catalog: ", err)
+				}
+			}
+			continue
+		}
+		log.Debug("Retention: removing ", record.category(), " file ", record.Name)
+		if record.stored() {
+			publishDeleted(record, "retention")
+			count++
+			deleteFile(record.Path)
+			removeDerivedFiles(record)
+		}
+		if err := fileCatalog.remove(record.Name); err != nil {
+			log.Warn("Cannot remove ", record.Name, " from the catalog: ", err)
+			continue
+		}
+		if record.Kind == kindEvent {
+			unlinkEventContext(record)
+		}
+	}
+	return count
+}
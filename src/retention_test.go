@@ -0,0 +1,160 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCheckHistoryReleasesEventPins(t *testing.T) {
+	newTestCatalog(t)
+	saved := cfg
+	defer func() { cfg = saved }()
+	cfg.EventHistory = 24 * time.Hour
+	cfg.HistoryLimit = 24 * time.Hour
+
+	stamp := func(age time.Duration) string {
+		return time.Now().Add(-age).In(cameraTZ).Format("20060102150405")
+	}
+	oldEvent := stamp(72*time.Hour) + "_0010_E.mp4"
+	newEvent := stamp(12*time.Hour) + "_0010_E.mp4"
+	aroundOld := stamp(72*time.Hour+time.Minute) + "_0060.mp4"
+	aroundBoth := stamp(72*time.Hour+2*time.Minute) + "_0060.mp4"
+	kept := stamp(72*time.Hour+3*time.Minute) + "_0060.mp4"
+	addTestRecord(t, oldEvent, kindEvent, nil)
+	addTestRecord(t, newEvent, kindEvent, nil)
+	for _, name := range []string{aroundOld, aroundBoth, kept} {
+		addTestRecord(t, name, kindRecording, nil)
+		linkEventContext(oldEvent, name)
+	}
+	linkEventContext(newEvent, aroundBoth)
+	if _, err := pin(kept, "manual"); err != nil {
+		t.Fatal(err)
+	}
+
+	checkHistory()
+	if _, found := fileCatalog.get(oldEvent); found {
+		t.Fatal("expired event kept")
+	}
+	if record, _ := fileCatalog.get(aroundOld); record.Pinned || len(record.Events) != 0 {
+		t.Errorf("context of the removed event still pinned: %+v", record)
+	}
+	if record, _ := fileCatalog.get(aroundBoth); !record.Pinned || !reflect.DeepEqual(record.Events, []string{newEvent}) {
+		t.Errorf("context of a remaining event: pinned %v, events %v", record.Pinned, record.Events)
+	}
+	if record, _ := fileCatalog.get(kept); !record.Pinned || record.PinReason != "manual" {
+		t.Errorf("manual pin lost: %+v", record)
+	}
+
+	// The released file goes with the next pass
+	checkHistory()
+	if _, found := fileCatalog.get(aroundOld); found {
+		t.Error("released context file kept past its retention")
+	}
+	for _, name := range []string{aroundBoth, kept} {
+		if _, found := fileCatalog.get(name); !found {
+			t.Errorf("pinned %s removed", name)
+		}
+	}
+}
+
+func TestCheckHistoryStitched(t *testing.T) {
+	newTestCatalog(t)
+	dir := t.TempDir()
+	saved := cfg
+	defer func() { cfg = saved }()
+	cfg.StitchedHistory = 24 * time.Hour
+
+	// Retention counts from when a video was stitched, not from its recordings
+	old := addStoredFile(t, dir, "20230601120000-20230601130000.mp4", kindStitched, 2048, func(r *fileRecord) {
+		r.DownloadedAt = time.Now().Add(-48 * time.Hour)
+	})
+	recent := addStoredFile(t, dir, "20230601140000.mp4", kindStitched, 2048, func(r *fileRecord) {
+		r.DownloadedAt = time.Now().Add(-time.Hour)
+	})
+
+	if count := checkHistory(); count != 1 {
+		t.Errorf("removed %d files, want 1", count)
+	}
+	if _, err := os.Stat(old); !os.IsNotExist(err) {
+		t.Error("expired stitched video kept")
+	}
+	if _, found := fileCatalog.get(filepath.Base(old)); found {
+		t.Error("expired stitched video still in the catalog")
+	}
+	if _, err := os.Stat(recent); err != nil {
+		t.Error("recent stitched video removed: ", err)
+	}
+}
+
+func TestCheckHistoryCondensed(t *testing.T) {
+	newTestCatalog(t)
+	dir := t.TempDir()
+	saved := cfg
+	defer func() { cfg = saved }()
+	cfg.ParkingHistory = 24 * time.Hour
+
+	old := addStoredFile(t, dir, "20230601020000.mp4", kindCondensed, 2048, func(r *fileRecord) {
+		r.DownloadedAt = time.Now().Add(-48 * time.Hour)
+	})
+	recent := addStoredFile(t, dir, "20230602020000.mp4", kindCondensed, 2048, func(r *fileRecord) {
+		r.DownloadedAt = time.Now().Add(-time.Hour)
+	})
+
+	if count := checkHistory(); count != 1 {
+		t.Errorf("removed %d files, want 1", count)
+	}
+	if _, err := os.Stat(old); !os.IsNotExist(err) {
+		t.Error("expired parking timelapse kept")
+	}
+	if _, err := os.Stat(recent); err != nil {
+		t.Error("recent parking timelapse removed: ", err)
+	}
+}
+
+func TestCheckHistoryForgetsFailedDownloads(t *testing.T) {
+	newTestCatalog(t)
+	saved := cfg
+	defer func() { cfg = saved }()
+	cfg.HistoryLimit = 24 * time.Hour
+
+	stamp := func(age time.Duration) string {
+		return time.Now().Add(-age).In(cameraTZ).Format("20060102150405")
+	}
+	failed := func(at time.Time) func(*fileRecord) {
+		return func(r *fileRecord) {
+			r.DownloadedAt = time.Time{}
+			r.Failures = []downloadFailure{{At: at, Error: "EOF"}}
+			r.SkippedAt = at
+		}
+	}
+	oldFailure := stamp(48*time.Hour) + "_0060.mp4"
+	newFailure := stamp(time.Hour) + "_0060.mp4"
+	pinnedFailure := stamp(48*time.Hour+time.Minute) + "_0060.mp4"
+	addTestRecord(t, oldFailure, kindRecording, failed(time.Now()))
+	addTestRecord(t, newFailure, kindRecording, failed(time.Now()))
+	addTestRecord(t, pinnedFailure, kindRecording, failed(time.Now()))
+	if _, err := pin(pinnedFailure, "manual"); err != nil {
+		t.Fatal(err)
+	}
+	// Without a camera time the last attempt counts
+	fileCatalog.update("unnamed-old.mp4", failed(time.Now().Add(-48*time.Hour)))
+	fileCatalog.update("unnamed-new.mp4", failed(time.Now().Add(-time.Hour)))
+
+	if count := checkHistory(); count != 0 {
+		t.Errorf("%d files removed from disk, want 0", count)
+	}
+	for name, kept := range map[string]bool{
+		oldFailure:        false,
+		newFailure:        true,
+		pinnedFailure:     true,
+		"unnamed-old.mp4": false,
+		"unnamed-new.mp4": true,
+	} {
+		if _, found := fileCatalog.get(name); found != kept {
+			t.Errorf("%s kept %v, want %v", name, found, kept)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"net/http"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cavaliergopher/grab/v3"
+	"github.com/labstack/echo/v4"
+)
+
+// Phases of the checkDashCam loop
+const (
+	phaseIdle        = "idle"
+	phaseCleaning    = "cleaning"
+	phaseConnecting  = "connecting"
+	phaseEvents      = "listing events"
+	phaseRecordings  = "listing recordings"
+	phaseDownloading = "downloading recordings"
+	phaseProcessing  = "post-processing"
+	phaseDeleting    = "deleting events"
+)
+
+type cameraStatus struct {
+	URL       string    `json:"url"`
+	Reachable bool      `json:"reachable"`
+	Session   bool      `json:"session"` // A session ID was handed out
+	CheckedAt time.Time `json:"checkedAt,omitempty"`
+}
+
+type syncRun struct {
+	StartedAt  time.Time `json:"startedAt,omitempty"`
+	FinishedAt time.Time `json:"finishedAt,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// activeDownload is a file being fetched, updated by the doDownload progress ticker
+type activeDownload struct {
+	Name           string    `json:"name"`
+	Category       category  `json:"category"`
+	Size           int64     `json:"size"`
+	Bytes          int64     `json:"bytes"`
+	Progress       float64   `json:"progress"` // 0 to 1
+	BytesPerSecond float64   `json:"bytesPerSecond"`
+	ETA            float64   `json:"eta"` // Seconds left, 0 when unknown
+	StartedAt      time.Time `json:"startedAt"`
+}
+
+type skipEntry struct {
+	URL      string    `json:"url"`
+	FailedAt time.Time `json:"failedAt"`
+	RetryAt  time.Time `json:"retryAt"`
+}
+
+// syncStatus is what GET /status reports about the checkDashCam loop
+type syncStatus struct {
+	mu          sync.Mutex
+	camera      cameraStatus
+	phase       string
+	phaseSince  time.Time
+	downloads   map[string]*activeDownload // By local path
+	queue       map[downloadClass]int
+	lastSync    syncRun
+	currentSync syncRun
+}
+
+var syncState = &syncStatus{phase: phaseIdle, phaseSince: time.Now(), downloads: map[string]*activeDownload{}}
+
+func (s *syncStatus) setPhase(phase string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.phase != phase {
+		s.phase = phase
+		s.phaseSince = time.Now()
+	}
+}
+
+// setCamera records a connection check; returns true when the camera came online or
+// went offline, or on the first check
+func (s *syncStatus) setCamera(reachable bool, session bool) (changed bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	changed = s.camera.CheckedAt.IsZero() || s.camera.Reachable != reachable
+	s.camera.Reachable = reachable
+	s.camera.Session = session
+	s.camera.CheckedAt = time.Now()
+	return changed
+}
+
+func (s *syncStatus) startSync() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.currentSync = syncRun{StartedAt: time.Now()}
+}
+
+// endSync moves the running sync to the last one
+func (s *syncStatus) endSync(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.currentSync.FinishedAt = time.Now()
+	if err != nil {
+		s.currentSync.Error = err.Error()
+	}
+	s.lastSync = s.currentSync
+	s.currentSync = syncRun{}
+	s.queue = nil
+}
+
+// setQueue records how many jobs of each class are left; called by the dispatcher,
+// which owns the queue
+func (s *syncStatus) setQueue(q *downloadQueue) {
+	counts := q.counts()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.queue = counts
+}
+
+func (s *syncStatus) startDownload(path string, f File) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.downloads[path] = &activeDownload{
+		Name:      f.name,
+		Category:  fileCategory(f.kind, f.name),
+		Size:      f.size,
+		StartedAt: time.Now(),
+	}
+}
+
+// downloadProgress copies the transfer state of a running download and returns it
+func (s *syncStatus) downloadProgress(path string, resp *grab.Response) (activeDownload, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d, found := s.downloads[path]
+	if !found {
+		return activeDownload{}, false
+	}
+	d.Bytes = resp.BytesComplete()
+	d.Progress = resp.Progress()
+	d.BytesPerSecond = resp.BytesPerSecond()
+	if size := resp.Size(); size > 0 {
+		d.Size = size
+	}
+	d.ETA = 0
+	if d.BytesPerSecond > 0 && d.Size > d.Bytes {
+		d.ETA = float64(d.Size-d.Bytes) / d.BytesPerSecond
+	}
+	return *d, true
+}
+
+func (s *syncStatus) finishDownload(path string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.downloads, path)
+}
+
+// statusReport is the body of GET /status
+type statusReport struct {
+	Camera      cameraStatus          `json:"camera"`
+	Phase       string                `json:"phase"`
+	PhaseSince  time.Time             `json:"phaseSince"`
+	Downloads   []activeDownload      `json:"downloads"`
+	Queue       map[downloadClass]int `json:"queue"`
+	CurrentSync *syncRun              `json:"currentSync,omitempty"`
+	LastSync    *syncRun              `json:"lastSync,omitempty"`
+	SkipCache   []skipEntry           `json:"skipCache"`
+}
+
+func (s *syncStatus) report() statusReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	report := statusReport{
+		Camera:     s.camera,
+		Phase:      s.phase,
+		PhaseSince: s.phaseSince,
+		Downloads:  []activeDownload{},
+		Queue:      map[downloadClass]int{},
+		SkipCache:  []skipEntry{},
+	}
+	if camera != nil {
+		report.Camera.URL = camera.baseURL()
+	}
+	for _, d := range s.downloads {
+		report.Downloads = append(report.Downloads, *d)
+	}
+	sort.Slice(report.Downloads, func(i, j int) bool { return report.Downloads[i].StartedAt.Before(report.Downloads[j].StartedAt) })
+	for class, count := range s.queue {
+		report.Queue[class] = count
+	}
+	if !s.currentSync.StartedAt.IsZero() {
+		current := s.currentSync
+		report.CurrentSync = &current
+	}
+	if !s.lastSync.StartedAt.IsZero() {
+		last := s.lastSync
+		report.LastSync = &last
+	}
+	return report
+}
+
+// skipCache lists the URLs downloadFile skips after they failed with EOF
+func skipCache() []skipEntry {
+	failedDownloadsMu.Lock()
+	defer failedDownloadsMu.Unlock()
+	pruneSkipCache()
+	entries := []skipEntry{}
+	for url, failedAt := range failedDownloads {
+		entries = append(entries, skipEntry{URL: url, FailedAt: failedAt, RetryAt: failedAt.Add(failedDownloadTTL)})
+	}
+	sort.Slice(entries, func(i, j int) bool { return filepath.Base(entries[i].URL) < filepath.Base(entries[j].URL) })
+	return entries
+}
+
+// statusHandler reports what the downloader is doing: GET /status
+func statusHandler(c echo.Context) error {
+	report := syncState.report()
+	report.SkipCache = skipCache()
+	return c.JSON(http.StatusOK, report)
+}
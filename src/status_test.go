@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStatusReportsCameraURL(t *testing.T) {
+	saved, savedCfg := camera, cfg
+	defer func() { camera, cfg = saved, savedCfg }()
+	cfg.CamURL = "http://193.168.0.1"
+	camera = makeCamera("http://127.0.0.1:8000", time.Second)
+
+	if got := syncState.report().Camera.URL; got != "http://127.0.0.1:8000" {
+		t.Errorf("camera URL %q, want the one the camera was built with", got)
+	}
+}
+
+func TestSkipCacheDropsExpiredEntries(t *testing.T) {
+	failedDownloadsMu.Lock()
+	saved := failedDownloads
+	failedDownloads = map[string]time.Time{
+		"http://camera/20230601120000_0060.mp4": time.Now().Add(-failedDownloadTTL - time.Minute),
+		"http://camera/20230601120100_0060.mp4": time.Now().Add(-time.Minute),
+	}
+	failedDownloadsMu.Unlock()
+	defer func() {
+		failedDownloadsMu.Lock()
+		failedDownloads = saved
+		failedDownloadsMu.Unlock()
+	}()
+
+	entries := skipCache()
+	if len(entries) != 1 || entries[0].URL != "http://camera/20230601120100_0060.mp4" {
+		t.Fatalf("got %+v, want only the recent failure", entries)
+	}
+	failedDownloadsMu.Lock()
+	defer failedDownloadsMu.Unlock()
+	if len(failedDownloads) != 1 {
+		t.Errorf("%d entries left in the skip cache, want 1", len(failedDownloads))
+	}
+}
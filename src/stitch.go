@@ -0,0 +1,410 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	log "github.com/sirupsen/logrus"
+)
+
+// Status of a stitch job
+const (
+	stitchQueued  = "queued"
+	stitchRunning = "running"
+	stitchDone    = "done"
+	stitchFailed  = "failed"
+)
+
+// Finished stitch jobs kept for the HTTP API
+const maxStitchHistory = 50
+
+// stitchJob joins the recordings of a trip or a time range into one MP4. With a
+// speed-up it re-encodes them into a timelapse instead.
+type stitchJob struct {
+	ID         string    `json:"id"`
+	Trip       string    `json:"trip,omitempty"`
+	From       time.Time `json:"from,omitempty"`
+	To         time.Time `json:"to,omitempty"`
+	Clips      []string  `json:"clips"`
+	Output     string    `json:"output"`
+	Speedup    float64   `json:"speedup,omitempty"`
+	Codec      string    `json:"codec,omitempty"`
+	Status     string    `json:"status"`
+	Progress   float64   `json:"progress"` // 0 to 1
+	Error      string    `json:"error,omitempty"`
+	QueuedAt   time.Time `json:"queuedAt"`
+	StartedAt  time.Time `json:"startedAt,omitempty"`
+	FinishedAt time.Time `json:"finishedAt,omitempty"`
+
+	records  []fileRecord
+	duration time.Duration // Sum of the clip lengths, for the progress
+	kind     fileKind      // Catalog kind of the output, empty to leave it out
+	done     func()        // Called once the output is in place
+}
+
+// stitcher runs the stitch jobs one at a time in the background
+type stitcher struct {
+	mu     sync.Mutex
+	jobs   []*stitchJob
+	queue  chan *stitchJob
+	nextID int
+}
+
+var stitchJobs = &stitcher{queue: make(chan *stitchJob, 100)}
+
+// run processes queued jobs until shutdown
+func (s *stitcher) run() {
+	for {
+		select {
+		case job := <-s.queue:
+			s.process(job)
+		case <-quit:
+			return
+		}
+	}
+}
+
+// submit queues a job. A job still waiting for the same output takes the new clip list instead.
+func (s *stitcher) submit(job *stitchJob) (*stitchJob, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, other := range s.jobs {
+		if other.Output == job.Output && other.Status == stitchQueued {
+			other.Clips, other.records, other.duration = job.Clips, job.records, job.duration
+			return other, nil
+		}
+	}
+	s.nextID++
+	job.ID = strconv.Itoa(s.nextID)
+	job.Status = stitchQueued
+	job.QueuedAt = time.Now()
+	select {
+	case s.queue <- job:
+	default:
+		return nil, errors.New("too many stitch jobs queued")
+	}
+	s.jobs = append(s.jobs, job)
+	s.trim()
+	log.Info("Stitch job ", job.ID, " queued: ", len(job.Clips), " clips to ", job.Output)
+	return job, nil
+}
+
+// trim forgets the oldest finished jobs; callers hold mu
+func (s *stitcher) trim() {
+	finished := 0
+	for _, job := range s.jobs {
+		if job.Status == stitchDone || job.Status == stitchFailed {
+			finished++
+		}
+	}
+	kept := s.jobs[:0]
+	for _, job := range s.jobs {
+		if finished > maxStitchHistory && (job.Status == stitchDone || job.Status == stitchFailed) {
+			finished--
+			continue
+		}
+		kept = append(kept, job)
+	}
+	s.jobs = kept
+}
+
+// update changes a job under the lock so the HTTP API reads consistent copies
+func (s *stitcher) update(job *stitchJob, fn func(*stitchJob)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fn(job)
+}
+
+// busy tells whether a job for output is waiting or running
+func (s *stitcher) busy(output string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, job := range s.jobs {
+		if job.Output == output && (job.Status == stitchQueued || job.Status == stitchRunning) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *stitcher) list() []stitchJob {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	jobs := make([]stitchJob, 0, len(s.jobs))
+	for i := len(s.jobs) - 1; i >= 0; i-- {
+		jobs = append(jobs, *s.jobs[i])
+	}
+	return jobs
+}
+
+func (s *stitcher) get(id string) (stitchJob, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, job := range s.jobs {
+		if job.ID == id {
+			return *job, true
+		}
+	}
+	return stitchJob{}, false
+}
+
+func (s *stitcher) process(job *stitchJob) {
+	// The clip list of a queued job can still change until it starts
+	var records []fileRecord
+	var duration time.Duration
+	s.update(job, func(j *stitchJob) {
+		j.Status = stitchRunning
+		j.StartedAt = time.Now()
+		records, duration = j.records, j.duration
+	})
+	encode := []string{"-map", "0", "-c", "copy"}
+	if job.Speedup > 0 {
+		encode = []string{"-an", "-vf", fmt.Sprintf("setpts=PTS/%g,fps=30", job.Speedup), "-c:v", job.Codec, "-pix_fmt", "yuv420p"}
+		duration = time.Duration(float64(duration) / job.Speedup)
+	}
+	log.Info("Stitching ", len(records), " clips to ", job.Output)
+	err := stitchClips(records, job.Output, encode, func(done time.Duration) {
+		if duration <= 0 {
+			return
+		}
+		s.update(job, func(j *stitchJob) {
+			j.Progress = done.Seconds() / duration.Seconds()
+			if j.Progress > 1 {
+				j.Progress = 1
+			}
+		})
+	})
+	s.update(job, func(j *stitchJob) {
+		j.FinishedAt = time.Now()
+		if err != nil {
+			j.Status = stitchFailed
+			j.Error = err.Error()
+			return
+		}
+		j.Status = stitchDone
+		j.Progress = 1
+	})
+	if err != nil {
+		log.Warn("Stitch job ", job.ID, " failed: ", err)
+		return
+	}
+	log.Info("Stitched ", job.Output, " in ", job.FinishedAt.Sub(job.StartedAt).Round(time.Second))
+	if job.kind != "" {
+		recordOutput(job.kind, job.Output, records[0].CameraTime)
+	}
+	if job.done != nil {
+		job.done()
+	}
+}
+
+// stitchClips concatenates the clips using the concat demuxer, encoded with the given
+// ffmpeg output options. The output gets the camera time of the first clip as its
+// modification time.
+func stitchClips(records []fileRecord, output string, encode []string, progress func(time.Duration)) error {
+	if err := os.MkdirAll(filepath.Dir(output), 0700); err != nil {
+		return err
+	}
+	list, err := os.CreateTemp(filepath.Dir(output), ".concat-*.txt")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(list.Name())
+	for _, record := range records {
+		path, err := filepath.Abs(record.Path)
+		if err != nil {
+			list.Close()
+			return err
+		}
+		list.WriteString(concatListEntry(path))
+	}
+	if err := list.Close(); err != nil {
+		return err
+	}
+
+	partial := output + partialSuffix
+	args := append([]string{"-f", "concat", "-safe", "0", "-i", list.Name()}, encode...)
+	err = runFFmpeg(append(args, "-movflags", "+faststart", "-f", "mp4", partial), progress)
+	if err == nil {
+		_, err = validateMP4(partial)
+	}
+	if err != nil {
+		removePartialFile(partial)
+		return err
+	}
+	if err := os.Chtimes(partial, records[0].CameraTime, records[0].CameraTime); err != nil {
+		log.Warn("Cannot set the time of ", output, ": ", err)
+	}
+	return os.Rename(partial, output)
+}
+
+// recordOutput adds a stitched video to the catalog, so retention and the storage
+// quota cover it, and makes room for it right away
+func recordOutput(kind fileKind, path string, cameraTime time.Time) {
+	var size int64
+	if info, err := os.Stat(path); err == nil {
+		size = info.Size()
+	}
+	err := fileCatalog.update(filepath.Base(path), func(r *fileRecord) {
+		r.Kind = kind
+		r.CameraTime = cameraTime
+		r.Size = size
+		r.DownloadedAt = time.Now()
+		r.Path = path
+		r.EvictedAt = time.Time{}
+	})
+	if err != nil {
+		log.Warn("Cannot record ", path, " in the catalog: ", err)
+		return
+	}
+	enforceQuota()
+}
+
+// newStitchJob prepares a job for the stored recordings among names
+func newStitchJob(names []string, output string) (*stitchJob, error) {
+	job := &stitchJob{Clips: []string{}, Output: output}
+	for _, name := range names {
+		record, found := fileCatalog.get(name)
+		if !found || !record.stored() {
+			continue
+		}
+		start, end := record.clipSpan()
+		job.records = append(job.records, record)
+		job.Clips = append(job.Clips, name)
+		job.duration += end.Sub(start)
+	}
+	if len(job.records) == 0 {
+		return nil, errors.New("no recordings on disk to stitch")
+	}
+	return job, nil
+}
+
+// tripVideoPathFor is where the stitched video of a trip goes
+func tripVideoPathFor(t trip) string {
+	return filepath.Join(cfg.StoragePath, "trips", t.ID+".mp4")
+}
+
+// stitchTrip queues a trip, written to trips/<id>.mp4
+func stitchTrip(t trip) (*stitchJob, error) {
+	job, err := newStitchJob(t.Clips, tripVideoPathFor(t))
+	if err != nil {
+		return nil, err
+	}
+	job.Trip = t.ID
+	job.kind = kindStitched
+	return stitchJobs.submit(job)
+}
+
+// stitchRange queues the continuous recordings overlapping [from, to], written to stitched/
+func stitchRange(from time.Time, to time.Time) (*stitchJob, error) {
+	if !to.After(from) {
+		return nil, errors.New("the end of the range must be after its start")
+	}
+	var names []string
+	for _, record := range fileCatalog.list() {
+		if record.Kind != kindRecording || record.category() != categoryContinuous {
+			continue
+		}
+		if start, end := record.clipSpan(); start.Before(to) && end.After(from) {
+			names = append(names, record.Name)
+		}
+	}
+	name := fmt.Sprintf("%s-%s.mp4", from.In(cameraTZ).Format("20060102150405"), to.In(cameraTZ).Format("20060102150405"))
+	job, err := newStitchJob(names, filepath.Join(cfg.StoragePath, "stitched", name))
+	if err != nil {
+		return nil, err
+	}
+	job.From, job.To = from, to
+	job.kind = kindStitched
+	return stitchJobs.submit(job)
+}
+
+// stitchFinishedTrips queues every trip that is over, has all its recordings on disk
+// and no video yet, or one older than some of its recordings. Trips still driving or
+// downloading are picked up by a later sync. Trips past STITCHED_HISTORY are left
+// alone, as is a video the storage quota evicted.
+func stitchFinishedTrips() {
+	for _, t := range fileCatalog.listTrips() {
+		if time.Since(t.End) < cfg.TripGap || time.Since(t.End) > cfg.StitchedHistory || len(t.Clips) == 0 {
+			continue
+		}
+		output := tripVideoPathFor(t)
+		if stitchJobs.busy(output) {
+			continue
+		}
+		video, stitched := fileCatalog.get(filepath.Base(output))
+		if stitched && !video.EvictedAt.IsZero() {
+			continue
+		}
+		complete, stale := true, !stitched || !video.stored()
+		for _, name := range t.Clips {
+			record, found := fileCatalog.get(name)
+			complete = complete && found && record.stored()
+			stale = stale || record.DownloadedAt.After(video.DownloadedAt)
+		}
+		if !stale {
+			continue
+		}
+		if !complete {
+			log.Debug("Not stitching trip ", t.ID, " yet: recordings missing")
+			continue
+		}
+		if _, err := stitchTrip(t); err != nil {
+			log.Warn("Cannot stitch trip ", t.ID, ": ", err)
+		}
+	}
+}
+
+// stitchRequest is the body of POST /api/stitch: a trip ID, or a time range
+type stitchRequest struct {
+	Trip string    `json:"trip"`
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+}
+
+// stitchHandler queues a stitch job: POST /api/stitch
+func stitchHandler(c echo.Context) error {
+	var req stitchRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid body"})
+	}
+	var job *stitchJob
+	var err error
+	switch {
+	case req.Trip != "":
+		t, found := fileCatalog.getTrip(req.Trip)
+		if !found {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "no trip " + req.Trip})
+		}
+		job, err = stitchTrip(t)
+	case !req.From.IsZero():
+		job, err = stitchRange(req.From, req.To)
+	default:
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "give a trip or a from/to range"})
+	}
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	queued, _ := stitchJobs.get(job.ID)
+	return c.JSON(http.StatusAccepted, queued)
+}
+
+// stitchJobsHandler lists the stitch jobs, newest first: GET /api/stitch
+func stitchJobsHandler(c echo.Context) error {
+	return c.JSON(http.StatusOK, stitchJobs.list())
+}
+
+// stitchJobHandler returns one stitch job: GET /api/stitch/:id
+func stitchJobHandler(c echo.Context) error {
+	job, found := stitchJobs.get(c.Param("id"))
+	if !found {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "no stitch job " + c.Param("id")})
+	}
+	return c.JSON(http.StatusOK, job)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// newTestStitcher replaces the stitch queue with one that nothing runs
+func newTestStitcher(t *testing.T) {
+	saved := stitchJobs
+	stitchJobs = &stitcher{queue: make(chan *stitchJob, 100)}
+	t.Cleanup(func() { stitchJobs = saved })
+}
+
+func TestStitchFinishedTripsAfterTheLastDownload(t *testing.T) {
+	newTestCatalog(t)
+	newTestStitcher(t)
+	dir := t.TempDir()
+	saved := cfg
+	defer func() { cfg = saved }()
+	cfg.StoragePath = dir
+	cfg.StitchedHistory = 168 * time.Hour
+	cfg.TripGap = 30 * time.Minute
+
+	now := time.Now().In(cameraTZ)
+	for _, age := range []time.Duration{12 * time.Minute, 11 * time.Minute} {
+		addStoredFile(t, dir, now.Add(-age).Format("20060102150405")+"_0060.mp4", kindRecording, 2048, func(r *fileRecord) {
+			r.DownloadedAt = time.Now()
+		})
+	}
+	changed := fileCatalog.rebuildTrips(cfg.TripGap)
+	if len(changed) != 1 {
+		t.Fatalf("got %d trips, want 1", len(changed))
+	}
+	output := tripVideoPathFor(changed[0])
+
+	// The last clip downloaded while the drive may still go on
+	stitchFinishedTrips()
+	if stitchJobs.busy(output) {
+		t.Fatal("trip stitched before the drive is over")
+	}
+
+	// Nothing new is downloaded, but by the next sync the drive is over
+	cfg.TripGap = 5 * time.Minute
+	stitchFinishedTrips()
+	if !stitchJobs.busy(output) {
+		t.Fatal("finished trip not stitched on a later sync")
+	}
+}
+
+func TestStitchFinishedTripsSkipsStitchedTrips(t *testing.T) {
+	newTestCatalog(t)
+	newTestStitcher(t)
+	dir := t.TempDir()
+	saved := cfg
+	defer func() { cfg = saved }()
+	cfg.StoragePath = dir
+	cfg.StitchedHistory = 168 * time.Hour
+	cfg.TripGap = 5 * time.Minute
+
+	clip := time.Now().In(cameraTZ).Add(-time.Hour).Format("20060102150405") + "_0060.mp4"
+	addStoredFile(t, dir, clip, kindRecording, 2048, func(r *fileRecord) {
+		r.DownloadedAt = time.Now().Add(-30 * time.Minute)
+	})
+	trips := fileCatalog.rebuildTrips(cfg.TripGap)
+	output := tripVideoPathFor(trips[0])
+	addStoredFile(t, dir, trips[0].ID+".mp4", kindStitched, 4096, func(r *fileRecord) {
+		r.DownloadedAt = time.Now().Add(-10 * time.Minute)
+	})
+
+	stitchFinishedTrips()
+	if stitchJobs.busy(output) {
+		t.Fatal("trip stitched again")
+	}
+
+	// A recording downloaded after the video makes it stale
+	fileCatalog.update(clip, func(r *fileRecord) { r.DownloadedAt = time.Now() })
+	stitchFinishedTrips()
+	if !stitchJobs.busy(output) {
+		t.Fatal("stale trip video not stitched again")
+	}
+
+	// The quota evicted it: not made again
+	newTestStitcher(t)
+	fileCatalog.update(trips[0].ID+".mp4", func(r *fileRecord) { r.Path, r.EvictedAt = "", time.Now() })
+	stitchFinishedTrips()
+	if stitchJobs.busy(output) {
+		t.Error("evicted trip video stitched again")
+	}
+}
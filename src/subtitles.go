@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// A cue is left out when the nearest GPS fix is further away than this
+const maxCueGap = 2 * time.Second
+
+// srtPathFor is where the subtitles of a recording go: next to it, with the .srt extension
+func srtPathFor(recording fileRecord) string {
+	return strings.TrimSuffix(recording.Path, filepath.Ext(recording.Path)) + ".srt"
+}
+
+// sameStem tells whether two camera files share the timestamp part of their name,
+// e.g. 20230101120000_0060.mp4 and 20230101120000_0060.git
+func sameStem(a string, b string) bool {
+	return strings.TrimSuffix(a, filepath.Ext(a)) == strings.TrimSuffix(b, filepath.Ext(b))
+}
+
+// withExt swaps the extension of a camera file name, e.g. for the GPS file of a recording
+func withExt(name string, ext string) string {
+	return strings.TrimSuffix(name, filepath.Ext(name)) + ext
+}
+
+// subtitlePair finds the stored recording and GPS file that belong together, starting
+// from either of them. The GPS list names the recording in Parentfile; files downloaded
+// without it are matched on their file name timestamp.
+func subtitlePair(record fileRecord) (recording fileRecord, gps fileRecord, found bool) {
+	switch record.Kind {
+	case kindGPS:
+		parent := record.Parent
+		if parent == "" {
+			parent = withExt(record.Name, ".mp4")
+		}
+		recording, found = fileCatalog.get(parent)
+		return recording, record, found && recording.Kind == kindRecording && recording.stored()
+	case kindRecording:
+		isPair := func(other fileRecord) bool {
+			return other.Kind == kindGPS && other.stored() &&
+				(other.Parent == record.Name || (other.Parent == "" && sameStem(other.Name, record.Name)))
+		}
+		if gps, found = fileCatalog.get(withExt(record.Name, ".git")); found && isPair(gps) {
+			return record, gps, true
+		}
+		// The GPS file may be named after another second than its recording
+		start, end := record.clipSpan()
+		for _, other := range fileCatalog.listBetween(start.Add(-defaultClipLength), end) {
+			if isPair(other) {
+				return record, other, true
+			}
+		}
+	}
+	return recording, gps, false
+}
+
+// exportSubtitles writes the .srt of a recording once both it and its GPS file are on disk
+func exportSubtitles(record fileRecord) {
+	recording, gps, found := subtitlePair(record)
+	if !found {
+		return
+	}
+	points, err := parseGPSFile(gps.Path)
+	if err != nil {
+		log.Warn("Cannot parse GPS file ", gps.Name, ": ", err)
+		return
+	}
+	start, end := recording.clipSpan()
+	data := buildSRT(points, start, end)
+	if len(data) == 0 {
+		log.Debug("No GPS fixes for the subtitles of ", recording.Name)
+		return
+	}
+	path := srtPathFor(recording)
+	if err := writeFileAtomic(path, data); err != nil {
+		log.Warn("Cannot write subtitles for ", recording.Name, ": ", err)
+		return
+	}
+	log.Debug("Wrote subtitles ", path)
+	if cfg.MuxSubtitles && !recording.SubtitlesMuxed {
+		muxSubtitles(recording, path)
+	}
+}
+
+// buildSRT makes one cue per second of the clip from the nearest GPS fix. When no fix
+// falls inside the clip, e.g. because CAMERA_TIMEZONE is wrong, the cues follow the
+// fixes from the first one on.
+func buildSRT(points []trackPoint, start time.Time, end time.Time) []byte {
+	if len(points) == 0 {
+		return nil
+	}
+	offset := time.Duration(0)
+	if points[len(points)-1].Time.Before(start) || !points[0].Time.Before(end) {
+		offset = points[0].Time.Sub(start)
+	}
+	var b strings.Builder
+	cue := 0
+	next := 0
+	for second := time.Duration(0); second < end.Sub(start); second += time.Second {
+		at := start.Add(second + offset)
+		// Points are in time order, so the nearest one only moves forward
+		for next+1 < len(points) && absDuration(points[next+1].Time.Sub(at)) <= absDuration(points[next].Time.Sub(at)) {
+			next++
+		}
+		p := points[next]
+		if absDuration(p.Time.Sub(at)) > maxCueGap {
+			continue
+		}
+		cue++
+		fmt.Fprintf(&b, "%d\n%s --> %s\n%s  %.0f km/h\n%s  %s\n\n",
+			cue,
+			srtTimestamp(second),
+			srtTimestamp(second+time.Second),
+			start.Add(second).In(cameraTZ).Format("2006-01-02 15:04:05"),
+			p.Speed,
+			formatLatLon(p.Lat, p.Lon),
+			formatHeading(p.Heading))
+	}
+	return []byte(b.String())
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
+
+// srtTimestamp formats an offset as hh:mm:ss,mmm
+func srtTimestamp(d time.Duration) string {
+	ms := d.Milliseconds()
+	return fmt.Sprintf("%02d:%02d:%02d,%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
+
+func formatLatLon(lat float64, lon float64) string {
+	ns, ew := "N", "E"
+	if lat < 0 {
+		ns = "S"
+	}
+	if lon < 0 {
+		ew = "W"
+	}
+	return fmt.Sprintf("%s %.5f %s %.5f", ns, math.Abs(lat), ew, math.Abs(lon))
+}
+
+// formatHeading shows degrees and the nearest of the 8 compass points
+func formatHeading(heading float64) string {
+	points := []string{"N", "NE", "E", "SE", "S", "SW", "W", "NW"}
+	i := int(math.Round(math.Mod(heading, 360)/45)) % len(points)
+	return fmt.Sprintf("%.0f° %s", heading, points[i])
+}
+
+// muxSubtitles adds the .srt to the recording as a mov_text subtitle stream. The
+// recording is replaced in place and keeps its modification time.
+func muxSubtitles(recording fileRecord, srtPath string) {
+	info, err := os.Stat(recording.Path)
+	if err != nil {
+		log.Warn("Cannot add subtitles to ", recording.Name, ": ", err)
+		return
+	}
+	partial := recording.Path + partialSuffix
+	err = runFFmpeg([]string{"-i", recording.Path, "-i", srtPath, "-map", "0", "-map", "1", "-c", "copy", "-c:s", "mov_text",
+		"-metadata:s:s:0", "language=eng", "-f", "mp4", partial}, nil)
+	if err == nil {
+		_, err = validateMP4(partial)
+	}
+	if err != nil {
+		log.Warn("Cannot add subtitles to ", recording.Name, ": ", err)
+		removePartialFile(partial)
+		return
+	}
+	if err := finishDownload(partial, recording.Path, info.ModTime()); err != nil {
+		log.Warn("Cannot add subtitles to ", recording.Name, ": ", err)
+		return
+	}
+	var size int64
+	if muxed, err := os.Stat(recording.Path); err == nil {
+		size = muxed.Size()
+	}
+	err = fileCatalog.update(recording.Name, func(r *fileRecord) {
+		r.SubtitlesMuxed = true
+		r.Size = size
+	})
+	if err != nil {
+		log.Warn("Cannot record the subtitles of ", recording.Name, ": ", err)
+	}
+	log.Info("Added subtitles to ", recording.Name)
+}
@@ -0,0 +1,43 @@
+package main
+
+import "testing"
+
+func TestSubtitlePair(t *testing.T) {
+	newTestCatalog(t)
+	dir := t.TempDir()
+	// Paired through Parentfile, though named a second later
+	recording := addStoredFile(t, dir, "20230601120000_0060.mp4", kindRecording, 2048, nil)
+	addStoredFile(t, dir, "20230601120001_0060.git", kindGPS, 2048, func(r *fileRecord) { r.Parent = "20230601120000_0060.mp4" })
+	// Paired on the file name
+	addStoredFile(t, dir, "20230601120100_0060.mp4", kindRecording, 2048, nil)
+	addStoredFile(t, dir, "20230601120100_0060.git", kindGPS, 2048, nil)
+	// GPS file of a recording that is not stored
+	addTestRecord(t, "20230601120200_0060.mp4", kindRecording, nil)
+	addStoredFile(t, dir, "20230601120200_0060.git", kindGPS, 2048, nil)
+
+	tests := []struct {
+		name      string
+		recording string
+		gps       string
+	}{
+		{name: "20230601120000_0060.mp4", recording: "20230601120000_0060.mp4", gps: "20230601120001_0060.git"},
+		{name: "20230601120001_0060.git", recording: "20230601120000_0060.mp4", gps: "20230601120001_0060.git"},
+		{name: "20230601120100_0060.mp4", recording: "20230601120100_0060.mp4", gps: "20230601120100_0060.git"},
+		{name: "20230601120100_0060.git", recording: "20230601120100_0060.mp4", gps: "20230601120100_0060.git"},
+		{name: "20230601120200_0060.git"},
+	}
+	for _, tt := range tests {
+		record, _ := fileCatalog.get(tt.name)
+		recording, gps, found := subtitlePair(record)
+		if found != (tt.recording != "") {
+			t.Errorf("%s: found %v", tt.name, found)
+			continue
+		}
+		if found && (recording.Name != tt.recording || gps.Name != tt.gps) {
+			t.Errorf("%s: paired %s with %s, want %s with %s", tt.name, recording.Name, gps.Name, tt.recording, tt.gps)
+		}
+	}
+	if record, _ := fileCatalog.get("20230601120000_0060.mp4"); record.Path != recording {
+		t.Errorf("recording path %q, want %q", record.Path, recording)
+	}
+}
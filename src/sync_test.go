@@ -0,0 +1,376 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mediaLog records the media requests a fake camera served, in order
+type mediaLog struct {
+	mu    sync.Mutex
+	names []string
+}
+
+func (l *mediaLog) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" && r.URL.Path != "/vcam/cmd.cgi" {
+			l.mu.Lock()
+			l.names = append(l.names, strings.TrimPrefix(r.URL.Path, "/"))
+			l.mu.Unlock()
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (l *mediaLog) requests() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.names...)
+}
+
+// newTestSync points the downloader at a camera served by handler, with a fresh
+// storage directory and catalog. Returns the storage directory.
+func newTestSync(t *testing.T, handler http.Handler) string {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	dir := t.TempDir()
+	savedCfg, savedDelay := cfg, downloadRetryDelay
+	cfg.StoragePath = dir
+	cfg.DownloadWorkers = 2
+	cfg.Thumbnails = false
+	cfg.StitchTrips = false
+	cfg.BuildTimelapse = false
+	cfg.DeleteEvents = false
+	cfg.DeleteDryRun = false
+	downloadRetryDelay = 10 * time.Millisecond
+
+	var err error
+	fileCatalog, err = openCatalog(filepath.Join(dir, "catalog.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	failedDownloadsMu.Lock()
+	failedDownloads = map[string]time.Time{}
+	failedDownloadsMu.Unlock()
+
+	camera = makeCamera(server.URL, time.Second)
+	if !camera.connect() {
+		t.Fatal("fake camera is not reachable")
+	}
+	t.Cleanup(func() {
+		fileCatalog.close()
+		cfg, downloadRetryDelay = savedCfg, savedDelay
+	})
+	return dir
+}
+
+// storedPath is where the downloader puts a camera file
+func storedPath(dir string, name string) string {
+	subdir := "recordings"
+	if strings.Contains(name, "_E.") {
+		subdir = "events"
+	}
+	return filepath.Join(dir, subdir, name)
+}
+
+func expectStored(t *testing.T, dir string, fake *fakeCamera, except string) {
+	t.Helper()
+	for name, file := range fake.files {
+		if name == except {
+			continue
+		}
+		info, err := os.Stat(storedPath(dir, name))
+		if err != nil {
+			t.Errorf("%s not downloaded: %v", name, err)
+			continue
+		}
+		if info.Size() != int64(len(file.data)) {
+			t.Errorf("%s: got %d bytes, want %d", name, info.Size(), len(file.data))
+		}
+		if record, found := fileCatalog.get(name); !found || !record.stored() {
+			t.Errorf("%s not recorded as stored in the catalog", name)
+		}
+	}
+}
+
+func expectNoPartials(t *testing.T, dir string) {
+	t.Helper()
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && strings.HasSuffix(path, partialSuffix) {
+			t.Errorf("unfinished download left behind: %s", path)
+		}
+		return nil
+	})
+}
+
+func TestSyncCamera(t *testing.T) {
+	fake := newSampleFakeCamera(time.Now())
+	dir := newTestSync(t, fake)
+
+	if err := syncCamera(dir, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	expectStored(t, dir, fake, "")
+	expectNoPartials(t, dir)
+	for _, gps := range fake.gpsFiles {
+		record, _ := fileCatalog.get(gps.name)
+		if record.Parent != gps.parent {
+			t.Errorf("%s: parent %q, want %q", gps.name, record.Parent, gps.parent)
+		}
+		if _, err := os.Stat(gpxPathFor(record)); err != nil {
+			t.Errorf("%s: no GPX export: %v", gps.name, err)
+		}
+	}
+	if trips := fileCatalog.listTrips(); len(trips) == 0 {
+		t.Error("no trip detected from the downloaded files")
+	}
+}
+
+func TestSyncCameraSkipsDownloadedFiles(t *testing.T) {
+	fake := newSampleFakeCamera(time.Now())
+	var media mediaLog
+	dir := newTestSync(t, media.wrap(fake))
+
+	if err := syncCamera(dir, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	first := len(media.requests())
+	if first != len(fake.files) {
+		t.Fatalf("got %d media requests, want %d", first, len(fake.files))
+	}
+	if err := syncCamera(dir, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if again := media.requests()[first:]; len(again) > 0 {
+		t.Errorf("downloaded again: %v", again)
+	}
+}
+
+func TestSyncCameraDeletesEvents(t *testing.T) {
+	fake := newSampleFakeCamera(time.Now())
+	dir := newTestSync(t, fake)
+	cfg.DeleteEvents = true
+
+	if err := syncCamera(dir, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.events) != 0 {
+		t.Errorf("%d events left on the camera, want 0", len(fake.events))
+	}
+	for _, event := range []string{"_E.mp4", "_E.jpg"} {
+		matches, _ := filepath.Glob(filepath.Join(dir, "events", "*"+event))
+		if len(matches) != 1 {
+			t.Errorf("want one local *%s, got %v", event, matches)
+		}
+	}
+}
+
+func TestSyncCameraQuirks(t *testing.T) {
+	tests := []struct {
+		name        string
+		quirk       fakeQuirk
+		pending     bool // Left alone until the camera lists a size
+		skipped     bool // Put in the skip cache
+		quarantined bool
+	}{
+		{name: "eof", quirk: quirkEOF, skipped: true},
+		{name: "stub", quirk: quirkStub},
+		{name: "zerosize", quirk: quirkZeroSize, pending: true},
+		{name: "vanish", quirk: quirkVanish},
+		{name: "nomoov", quirk: quirkNoMoov, quarantined: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := time.Now()
+			fake := newSampleFakeCamera(now)
+			name := now.Add(-time.Minute).In(cameraTZ).Format("20060102150405") + "_0060.mp4"
+			fake.addRecording(name, fakeMP4(64*1024, time.Minute))
+			fake.setQuirk(name, tt.quirk)
+			var media mediaLog
+			dir := newTestSync(t, media.wrap(fake))
+
+			if err := syncCamera(dir, 5*time.Second); err != nil {
+				t.Fatal(err)
+			}
+			// The other files are not held up by the broken one
+			expectStored(t, dir, fake, name)
+			expectNoPartials(t, dir)
+
+			if tt.pending {
+				if _, found := fileCatalog.get(name); found {
+					t.Fatalf("%s downloaded while still being written", name)
+				}
+				fake.setQuirk(name, quirkNone)
+				if err := syncCamera(dir, 5*time.Second); err != nil {
+					t.Fatal(err)
+				}
+				expectStored(t, dir, fake, "")
+				return
+			}
+
+			record, found := fileCatalog.get(name)
+			if !found {
+				t.Fatalf("%s not in the catalog", name)
+			}
+			_, err := os.Stat(storedPath(dir, name))
+			if err == nil || record.downloaded() {
+				t.Error("broken download kept")
+			}
+			if len(record.Failures) == 0 {
+				t.Error("failure not recorded")
+			}
+
+			failedDownloadsMu.Lock()
+			_, inCache := failedDownloads[camera.fileURL(name)]
+			failedDownloadsMu.Unlock()
+			if inCache != tt.skipped || record.SkippedAt.IsZero() == tt.skipped {
+				t.Errorf("skip cache: got %v, want %v", inCache, tt.skipped)
+			}
+
+			_, err = os.Stat(filepath.Join(dir, "quarantine", name))
+			if (err == nil) != tt.quarantined {
+				t.Errorf("quarantined: got %v, want %v", err == nil, tt.quarantined)
+			}
+			if tt.quarantined && record.Validation != validationInvalid {
+				t.Errorf("validation %q, want %q", record.Validation, validationInvalid)
+			}
+
+			// A skipped file is not requested again until its TTL ends
+			before := len(media.requests())
+			if err := syncCamera(dir, 5*time.Second); err != nil {
+				t.Fatal(err)
+			}
+			retried := len(media.requests()) > before
+			if retried == tt.skipped {
+				t.Errorf("retried on the next sync: %v, want %v", retried, !tt.skipped)
+			}
+		})
+	}
+}
+
+func TestDownloadAllRefreshJumpsTheQueue(t *testing.T) {
+	now := time.Now().In(cameraTZ)
+	fake := newFakeCamera()
+	newest := ""
+	for i := 3; i >= 1; i-- {
+		newest = now.Add(-time.Duration(i)*24*time.Hour).Format("20060102150405") + "_0060.mp4"
+		fake.addRecording(newest, fakeMP4(16*1024, time.Minute))
+	}
+	var media mediaLog
+	dir := newTestSync(t, media.wrap(fake))
+
+	err, recordings := camera.getRecordings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue := newDownloadQueue(cfg.priorityRanks)
+	for _, recording := range recordings {
+		queue.push(downloadJob{file: recording, path: storedPath(dir, recording.name), class: classBackfill})
+	}
+	// An event shows up on the camera while the first recording downloads
+	stamp := now.Format("20060102150405")
+	event := stamp + "_0010_E.mp4"
+	refreshed := false
+	refresh := func(q *downloadQueue) {
+		if refreshed {
+			return
+		}
+		refreshed = true
+		fake.addEvent(event, fakeMP4(16*1024, 10*time.Second), stamp+"_0010_E.jpg", randomBytes(4*1024))
+		_, events := camera.getEvents()
+		for _, e := range events {
+			q.push(downloadJob{file: e, path: storedPath(dir, e.name), class: classEvent})
+		}
+	}
+	if err := downloadAll(queue, 1, 5*time.Second, refresh); err != nil {
+		t.Fatal(err)
+	}
+
+	got := media.requests()
+	if len(got) != 5 {
+		t.Fatalf("got requests %v, want 5", got)
+	}
+	if got[0] != newest || got[1] != event {
+		t.Errorf("got order %v, want the newest recording, then %s", got, event)
+	}
+	expectStored(t, dir, fake, "")
+}
+
+func TestDownloadAllStopsWhenExiting(t *testing.T) {
+	fake := newSampleFakeCamera(time.Now())
+	var media mediaLog
+	dir := newTestSync(t, media.wrap(fake))
+	queue := newDownloadQueue(cfg.priorityRanks)
+	_, recordings := camera.getRecordings()
+	for _, recording := range recordings {
+		queue.push(downloadJob{file: recording, path: storedPath(dir, recording.name), class: classRecent})
+	}
+
+	Exiting.Store(true)
+	defer Exiting.Store(false)
+	if err := downloadAll(queue, 2, 5*time.Second, nil); !errors.Is(err, ErrExiting) {
+		t.Fatalf("got %v, want ErrExiting", err)
+	}
+	if got := media.requests(); len(got) != 0 {
+		t.Errorf("downloads started after the shutdown request: %v", got)
+	}
+}
+
+func TestSyncCameraSkipsExpiredEvents(t *testing.T) {
+	now := time.Now()
+	fake := newSampleFakeCamera(now)
+	old := now.Add(-72*time.Hour).In(cameraTZ).Format("20060102150405") + "_0010_E"
+	fake.addEvent(old+".mp4", fakeMP4(16*1024, 10*time.Second), old+".jpg", randomBytes(4*1024))
+	var media mediaLog
+	dir := newTestSync(t, media.wrap(fake))
+	cfg.EventHistory = 24 * time.Hour
+	cfg.DeleteEvents = true
+
+	// The event list is fetched again after every download; the old event stays out
+	if err := syncCamera(dir, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range media.requests() {
+		if strings.HasPrefix(name, old) {
+			t.Errorf("expired event downloaded: %s", name)
+		}
+	}
+	if _, found := fileCatalog.get(old + ".mp4"); found {
+		t.Error("expired event recorded in the catalog")
+	}
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	if _, onCamera := fake.files[old+".mp4"]; !onCamera {
+		t.Error("expired event deleted from the camera")
+	}
+}
+
+func TestSyncCameraKeepsEventsWithoutSize(t *testing.T) {
+	fake := newSampleFakeCamera(time.Now())
+	stamp := time.Now().Add(-time.Minute).In(cameraTZ).Format("20060102150405")
+	event := stamp + "_0010_E.mp4"
+	fake.addEvent(event, fakeMP4(16*1024, 10*time.Second), stamp+"_0010_E.jpg", randomBytes(4*1024))
+	fake.setQuirk(event, quirkBadSize)
+	dir := newTestSync(t, fake)
+	cfg.DeleteEvents = true
+
+	if err := syncCamera(dir, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	expectStored(t, dir, fake, "")
+	// Its download cannot be verified against the camera, so it stays there
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	if len(fake.events) != 1 || fake.events[0].video.name != event {
+		t.Errorf("events left on the camera: %d, want only %s", len(fake.events), event)
+	}
+}
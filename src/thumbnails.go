@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/labstack/echo/v4"
+	log "github.com/sirupsen/logrus"
+)
+
+// Layout of the per-trip contact sheets
+const (
+	contactSheetColumns = 6
+	contactSheetMax     = 60 // Thumbnails, picked evenly over the trip
+)
+
+var (
+	ffmpegOnce  sync.Once
+	ffmpegFound bool
+)
+
+// thumbnailJobs holds the thumbnail and contact sheet work, done one at a time in order
+// so ffmpeg never holds up a download worker
+var thumbnailJobs = make(chan func(), 1000)
+
+// queueThumbnailJob hands work to the thumbnail worker; it is dropped when the queue is full
+func queueThumbnailJob(job func()) {
+	select {
+	case thumbnailJobs <- job:
+	default:
+		log.Warn("Too many thumbnails queued, skipping one")
+	}
+}
+
+// runThumbnailJobs does the queued thumbnail work until the process exits
+func runThumbnailJobs() {
+	for job := range thumbnailJobs {
+		if Exiting.Load() {
+			continue
+		}
+		job()
+	}
+}
+
+// ffmpegAvailable tells whether FFMPEG_PATH can be run; optional steps are skipped without it
+func ffmpegAvailable() bool {
+	ffmpegOnce.Do(func() {
+		_, err := exec.LookPath(cfg.FFmpegPath)
+		ffmpegFound = err == nil
+		if !ffmpegFound {
+			log.Info("ffmpeg not found at ", cfg.FFmpegPath, ", thumbnails are not made")
+		}
+	})
+	return ffmpegFound
+}
+
+// thumbnailPathFor is where the thumbnail of a recording goes
+func thumbnailPathFor(recording fileRecord) string {
+	return filepath.Join(cfg.StoragePath, "thumbnails", strings.TrimSuffix(recording.Name, filepath.Ext(recording.Name))+".jpg")
+}
+
+// exportThumbnail grabs the frame in the middle of a recording and records it in the catalog
+func exportThumbnail(recording fileRecord) {
+	if !ffmpegAvailable() {
+		return
+	}
+	path := thumbnailPathFor(recording)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		log.Warn("Cannot create thumbnail directory: ", err)
+		return
+	}
+	start, end := recording.clipSpan()
+	seek := end.Sub(start) / 2
+	partial := path + partialSuffix
+	err := runFFmpeg([]string{"-ss", fmt.Sprintf("%.3f", seek.Seconds()), "-i", recording.Path, "-frames:v", "1",
+		"-vf", fmt.Sprintf("scale=%d:-2", cfg.ThumbnailWidth), "-q:v", "4", "-f", "mjpeg", partial}, nil)
+	if err == nil {
+		err = checkImage(partial)
+	}
+	if err == nil {
+		err = os.Rename(partial, path)
+	}
+	if err != nil {
+		log.Warn("Cannot make a thumbnail of ", recording.Name, ": ", err)
+		removePartialFile(partial)
+		return
+	}
+	if err := fileCatalog.update(recording.Name, func(r *fileRecord) { r.Thumbnail = path }); err != nil {
+		log.Warn("Cannot record the thumbnail of ", recording.Name, ": ", err)
+		return
+	}
+	log.Debug("Made thumbnail ", path)
+}
+
+// checkImage makes sure ffmpeg wrote something; it exits cleanly when the seek is past the end
+func checkImage(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.Size() == 0 {
+		return fmt.Errorf("no frame written")
+	}
+	return nil
+}
+
+// contactSheetPathFor is where the contact sheet of a trip goes
+func contactSheetPathFor(t trip) string {
+	return filepath.Join(cfg.StoragePath, "trips", t.ID+".jpg")
+}
+
+// exportContactSheet tiles the thumbnails of a trip's recordings into one image
+func exportContactSheet(t trip) {
+	if !ffmpegAvailable() {
+		return
+	}
+	var thumbnails []string
+	for _, name := range t.Clips {
+		if record, found := fileCatalog.get(name); found && record.Thumbnail != "" {
+			thumbnails = append(thumbnails, record.Thumbnail)
+		}
+	}
+	if len(thumbnails) == 0 {
+		return
+	}
+	if len(thumbnails) > contactSheetMax {
+		picked := make([]string, contactSheetMax)
+		for i := range picked {
+			picked[i] = thumbnails[i*len(thumbnails)/contactSheetMax]
+		}
+		thumbnails = picked
+	}
+	columns := contactSheetColumns
+	if len(thumbnails) < columns {
+		columns = len(thumbnails)
+	}
+	rows := (len(thumbnails) + columns - 1) / columns
+
+	path := contactSheetPathFor(t)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		log.Warn("Cannot create trips directory: ", err)
+		return
+	}
+	list, err := os.CreateTemp(filepath.Dir(path), ".sheet-*.txt")
+	if err != nil {
+		log.Warn("Cannot make the contact sheet of trip ", t.ID, ": ", err)
+		return
+	}
+	defer os.Remove(list.Name())
+	for _, thumbnail := range thumbnails {
+		abs, _ := filepath.Abs(thumbnail)
+		list.WriteString(concatListEntry(abs))
+	}
+	list.Close()
+
+	partial := path + partialSuffix
+	err = runFFmpeg([]string{"-f", "concat", "-safe", "0", "-i", list.Name(), "-frames:v", "1",
+		"-vf", fmt.Sprintf("tile=%dx%d:padding=4:margin=4", columns, rows), "-q:v", "4", "-f", "mjpeg", partial}, nil)
+	if err == nil {
+		err = checkImage(partial)
+	}
+	if err == nil {
+		err = os.Rename(partial, path)
+	}
+	if err != nil {
+		log.Warn("Cannot make the contact sheet of trip ", t.ID, ": ", err)
+		removePartialFile(partial)
+		return
+	}
+	log.Info("Made contact sheet ", path, " of ", len(thumbnails), " thumbnails")
+}
+
+// exportContactSheets remakes the contact sheets of the changed trips. Queued behind the
+// thumbnails of the sync, so the sheets include them.
+func exportContactSheets(trips []trip) {
+	for _, t := range trips {
+		if Exiting.Load() {
+			return
+		}
+		exportContactSheet(t)
+	}
+}
+
+// thumbnailHandler serves the thumbnail of a recording, or the camera's own for events:
+// GET /api/thumbnails/:name
+func thumbnailHandler(c echo.Context) error {
+	name := c.Param("name")
+	record, found := fileCatalog.get(name)
+	if !found {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "unknown file " + name})
+	}
+	path := record.Thumbnail
+	if record.Kind == kindEvent {
+		jpg := strings.TrimSuffix(name, filepath.Ext(name)) + ".jpg"
+		if thumb, found := fileCatalog.get(jpg); found && thumb.stored() {
+			path = thumb.Path
+		}
+	}
+	if path == "" {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "no thumbnail for " + name})
+	}
+	c.Response().Header().Set(echo.HeaderCacheControl, "max-age=3600")
+	return c.File(path)
+}
+
+// contactSheetHandler serves the contact sheet of a trip: GET /api/trips/:id/contactsheet
+func contactSheetHandler(c echo.Context) error {
+	t, found := fileCatalog.getTrip(c.Param("id"))
+	if !found {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "no trip " + c.Param("id")})
+	}
+	path := contactSheetPathFor(t)
+	if _, err := os.Stat(path); err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "no contact sheet for trip " + t.ID})
+	}
+	return c.File(path)
+}
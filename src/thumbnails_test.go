@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestProcessDownloadQueuesThumbnail(t *testing.T) {
+	newTestCatalog(t)
+	saved, savedJobs := cfg, thumbnailJobs
+	defer func() { cfg, thumbnailJobs = saved, savedJobs }()
+	thumbnailJobs = make(chan func(), 10)
+	cfg.Thumbnails = true
+	cfg.SrtExport = false
+	cfg.FFmpegPath = "ffmpeg-not-installed"
+
+	name := "20230601120000_0060.mp4"
+	path := addStoredFile(t, t.TempDir(), name, kindRecording, 2048, nil)
+	file := File{kind: kindRecording, name: name, date: time.Now()}
+
+	// The download worker only queues the thumbnail
+	processDownload(file, path)
+	if len(thumbnailJobs) != 1 {
+		t.Fatalf("%d thumbnail jobs queued, want 1", len(thumbnailJobs))
+	}
+
+	// The file is gone by the time the job runs: nothing to do
+	fileCatalog.update(name, func(r *fileRecord) { r.Path, r.EvictedAt = "", time.Now() })
+	(<-thumbnailJobs)()
+	if record, _ := fileCatalog.get(name); record.Thumbnail != "" {
+		t.Errorf("thumbnail recorded for an evicted file: %s", record.Thumbnail)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"path/filepath"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// parkingSession is a run of parking mode recordings of one day less than TRIP_GAP apart
+type parkingSession struct {
+	ID      string // Camera time of the first clip
+	Start   time.Time
+	End     time.Time
+	records []fileRecord
+}
+
+// parkingSessions groups the downloaded parking recordings per day into sessions.
+// Records must be sorted by camera time, as catalog.list returns them.
+func parkingSessions(records []fileRecord, gap time.Duration) (sessions []parkingSession) {
+	var current *parkingSession
+	for _, record := range records {
+		if record.Kind != kindRecording || record.category() != categoryTimelapse || !record.downloaded() {
+			continue
+		}
+		start, end := record.clipSpan()
+		if current == nil || start.Sub(current.End) > gap || !sameDay(start, current.Start) {
+			sessions = append(sessions, parkingSession{ID: tripID(start), Start: start, End: end})
+			current = &sessions[len(sessions)-1]
+		}
+		if end.After(current.End) {
+			current.End = end
+		}
+		current.records = append(current.records, record)
+	}
+	return sessions
+}
+
+func sameDay(a time.Time, b time.Time) bool {
+	a, b = a.In(cameraTZ), b.In(cameraTZ)
+	return a.YearDay() == b.YearDay() && a.Year() == b.Year()
+}
+
+// timelapsePathFor is where the timelapse of a parking session goes
+func timelapsePathFor(session parkingSession) string {
+	return filepath.Join(cfg.StoragePath, "timelapse", session.ID+".mp4")
+}
+
+// buildTimelapses queues a timelapse for every finished parking session that has
+// recordings not condensed yet. Sessions with recordings missing on disk wait for
+// a later sync.
+func buildTimelapses() {
+	for _, session := range parkingSessions(fileCatalog.list(), cfg.TripGap) {
+		if time.Since(session.End) < cfg.TripGap {
+			continue
+		}
+		pending, complete := false, true
+		names := []string{}
+		for _, record := range session.records {
+			pending = pending || record.Timelapse == ""
+			complete = complete && record.stored()
+			names = append(names, record.Name)
+		}
+		output := timelapsePathFor(session)
+		if !pending || stitchJobs.busy(output) {
+			continue
+		}
+		if !complete {
+			log.Debug("Not building the timelapse of parking session ", session.ID, ": recordings missing")
+			continue
+		}
+		job, err := newStitchJob(names, output)
+		if err != nil {
+			log.Warn("Cannot build the timelapse of parking session ", session.ID, ": ", err)
+			continue
+		}
+		job.Speedup = cfg.TimelapseSpeedup
+		job.Codec = cfg.TimelapseCodec
+		job.kind = kindCondensed
+		job.done = func() { markCondensed(names, filepath.Base(output)) }
+		if _, err := stitchJobs.submit(job); err != nil {
+			log.Warn("Cannot build the timelapse of parking session ", session.ID, ": ", err)
+		}
+	}
+}
+
+// markCondensed records the timelapse the parking recordings went into, which makes
+// them eligible for TIMELAPSE_SOURCE_HISTORY
+func markCondensed(names []string, timelapse string) {
+	for _, name := range names {
+		err := fileCatalog.update(name, func(r *fileRecord) { r.Timelapse = timelapse })
+		if err != nil {
+			log.Warn("Cannot record the timelapse of ", name, ": ", err)
+		}
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	log "github.com/sirupsen/logrus"
+)
+
+// Mean earth radius in meters
+const earthRadius = 6371000.0
+
+// trackFormat is a file format trips can be exported to
+type trackFormat struct {
+	ext         string
+	contentType string
+	encode      func(name string, tracks []track, videos []string) ([]byte, error)
+}
+
+var trackFormats = map[string]trackFormat{
+	"gpx":     {ext: ".gpx", contentType: "application/gpx+xml", encode: encodeGPX},
+	"geojson": {ext: ".geojson", contentType: "application/geo+json", encode: encodeGeoJSON},
+	"kml":     {ext: ".kml", contentType: "application/vnd.google-earth.kml+xml", encode: encodeKML},
+}
+
+// parseTripExport keeps the known formats of TRIP_EXPORT
+func parseTripExport(names []string) (formats []string) {
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if _, ok := trackFormats[name]; ok {
+			formats = append(formats, name)
+		} else if name != "" {
+			log.Warn("Unknown TRIP_EXPORT format: ", name)
+		}
+	}
+	return formats
+}
+
+// trackStats summarises the tracks of a trip
+type trackStats struct {
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Distance float64   `json:"distance"` // Meters
+	MaxSpeed float64   `json:"maxSpeed"` // km/h
+	AvgSpeed float64   `json:"avgSpeed"` // km/h, distance over time
+	Videos   []string  `json:"videos"`
+	GpsFiles []string  `json:"gpsFiles"`
+}
+
+// linkedVideos returns the recordings of a trip, or when there are none the
+// recordings the GPS files belong to
+func linkedVideos(tracks []track, videos []string) []string {
+	if len(videos) > 0 {
+		return videos
+	}
+	videos = []string{}
+	for _, t := range tracks {
+		if t.Video != "" {
+			videos = append(videos, t.Video)
+		}
+	}
+	return videos
+}
+
+func computeTrackStats(tracks []track, videos []string) (stats trackStats) {
+	stats.Videos = linkedVideos(tracks, videos)
+	stats.GpsFiles = []string{}
+	for _, t := range tracks {
+		stats.GpsFiles = append(stats.GpsFiles, t.Name)
+		for i, p := range t.Points {
+			if stats.Start.IsZero() || p.Time.Before(stats.Start) {
+				stats.Start = p.Time
+			}
+			if p.Time.After(stats.End) {
+				stats.End = p.Time
+			}
+			stats.MaxSpeed = math.Max(stats.MaxSpeed, p.Speed)
+			if i > 0 {
+				stats.Distance += haversine(t.Points[i-1], p)
+			}
+		}
+	}
+	if hours := stats.End.Sub(stats.Start).Hours(); hours > 0 {
+		stats.AvgSpeed = stats.Distance / 1000 / hours
+	}
+	return stats
+}
+
+// haversine is the great-circle distance between two fixes in meters
+func haversine(a trackPoint, b trackPoint) float64 {
+	rad := func(deg float64) float64 { return deg * math.Pi / 180 }
+	dLat := rad(b.Lat - a.Lat)
+	dLon := rad(b.Lon - a.Lon)
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(rad(a.Lat))*math.Cos(rad(b.Lat))*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(h))
+}
+
+// GeoJSON Feature with a LineString geometry, see RFC 7946
+type geoJSONFeature struct {
+	Type       string            `json:"type"`
+	Geometry   geoJSONLineString `json:"geometry"`
+	Properties geoJSONProperties `json:"properties"`
+}
+
+type geoJSONLineString struct {
+	Type        string      `json:"type"`
+	Coordinates [][]float64 `json:"coordinates"` // [lon, lat], with the altitude when the fix has one
+}
+
+type geoJSONProperties struct {
+	Name string `json:"name"`
+	trackStats
+}
+
+// encodeGeoJSON renders the tracks as a single LineString Feature
+func encodeGeoJSON(name string, tracks []track, videos []string) ([]byte, error) {
+	feature := geoJSONFeature{
+		Type:       "Feature",
+		Geometry:   geoJSONLineString{Type: "LineString", Coordinates: [][]float64{}},
+		Properties: geoJSONProperties{Name: name, trackStats: computeTrackStats(tracks, videos)},
+	}
+	for _, t := range tracks {
+		for _, p := range t.Points {
+			position := []float64{roundCoordinate(p.Lon), roundCoordinate(p.Lat)}
+			if p.HasAltitude {
+				position = append(position, p.Altitude)
+			}
+			feature.Geometry.Coordinates = append(feature.Geometry.Coordinates, position)
+		}
+	}
+	if len(feature.Geometry.Coordinates) < 2 {
+		return nil, fmt.Errorf("%w for %s", ErrNoFixes, name)
+	}
+	return json.MarshalIndent(feature, "", "  ")
+}
+
+// roundCoordinate keeps 7 decimals, about a centimeter
+func roundCoordinate(deg float64) float64 {
+	return math.Round(deg*1e7) / 1e7
+}
+
+// KML 2.2 document with one Placemark, see https://developers.google.com/kml/documentation/kmlreference
+type kmlDocument struct {
+	XMLName   xml.Name     `xml:"kml"`
+	Xmlns     string       `xml:"xmlns,attr"`
+	Name      string       `xml:"Document>name"`
+	Placemark kmlPlacemark `xml:"Document>Placemark"`
+}
+
+type kmlPlacemark struct {
+	Name        string        `xml:"name"`
+	Description string        `xml:"description"`
+	Begin       string        `xml:"TimeSpan>begin"`
+	End         string        `xml:"TimeSpan>end"`
+	Data        []kmlData     `xml:"ExtendedData>Data"`
+	LineString  kmlLineString `xml:"LineString"`
+}
+
+type kmlData struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value"`
+}
+
+type kmlLineString struct {
+	Tessellate   int    `xml:"tessellate"`
+	AltitudeMode string `xml:"altitudeMode"`
+	Coordinates  string `xml:"coordinates"` // lon,lat[,altitude] tuples separated by spaces
+}
+
+// encodeKML renders the tracks as a single LineString Placemark
+func encodeKML(name string, tracks []track, videos []string) ([]byte, error) {
+	stats := computeTrackStats(tracks, videos)
+	// One altitude mode covers the whole line, so altitudes are written only if every fix has one
+	withAltitude := true
+	for _, t := range tracks {
+		for _, p := range t.Points {
+			withAltitude = withAltitude && p.HasAltitude
+		}
+	}
+	var coordinates []string
+	for _, t := range tracks {
+		for _, p := range t.Points {
+			if withAltitude {
+				coordinates = append(coordinates, fmt.Sprintf("%.7f,%.7f,%.1f", p.Lon, p.Lat, p.Altitude))
+			} else {
+				coordinates = append(coordinates, fmt.Sprintf("%.7f,%.7f", p.Lon, p.Lat))
+			}
+		}
+	}
+	if len(coordinates) < 2 {
+		return nil, fmt.Errorf("%w for %s", ErrNoFixes, name)
+	}
+	doc := kmlDocument{
+		Xmlns: "http://www.opengis.net/kml/2.2",
+		Name:  name,
+		Placemark: kmlPlacemark{
+			Name: name,
+			Description: fmt.Sprintf("%.1f km, max %.0f km/h, avg %.0f km/h",
+				stats.Distance/1000, stats.MaxSpeed, stats.AvgSpeed),
+			Begin: stats.Start.UTC().Format(time.RFC3339),
+			End:   stats.End.UTC().Format(time.RFC3339),
+			Data: []kmlData{
+				{Name: "start", Value: stats.Start.UTC().Format(time.RFC3339)},
+				{Name: "end", Value: stats.End.UTC().Format(time.RFC3339)},
+				{Name: "distance", Value: strconv.FormatFloat(stats.Distance, 'f', 0, 64)},
+				{Name: "maxSpeed", Value: strconv.FormatFloat(stats.MaxSpeed, 'f', 1, 64)},
+				{Name: "avgSpeed", Value: strconv.FormatFloat(stats.AvgSpeed, 'f', 1, 64)},
+				{Name: "videos", Value: strings.Join(stats.Videos, ",")},
+			},
+			LineString: kmlLineString{
+				Tessellate:   1,
+				AltitudeMode: "clampToGround",
+				Coordinates:  strings.Join(coordinates, " "),
+			},
+		},
+	}
+	data, err := xml.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), data...), nil
+}
+
+// loadTracks parses the GPS files of a trip, skipping unreadable ones
+func loadTracks(records []fileRecord) (tracks []track) {
+	for _, record := range records {
+		t, err := loadTrack(record)
+		if err != nil {
+			log.Warn("Cannot parse GPS file ", record.Name, ": ", err)
+			continue
+		}
+		tracks = append(tracks, t)
+	}
+	return tracks
+}
+
+// exportTrips writes the TRIP_EXPORT formats of the given trips to the trips directory
+func exportTrips(storagePath string, trips []trip) {
+	if len(cfg.TripExport) == 0 {
+		return
+	}
+	dir := filepath.Join(storagePath, "trips")
+	for _, t := range trips {
+		tracks := loadTracks(t.gpsRecords())
+		for _, name := range cfg.TripExport {
+			format := trackFormats[name]
+			path := filepath.Join(dir, t.ID+format.ext)
+			data, err := format.encode("Trip "+t.ID, tracks, t.Clips)
+			if err == nil {
+				err = writeFileAtomic(path, data)
+			}
+			if errors.Is(err, ErrNoFixes) {
+				log.Debug("Nothing to export for trip ", t.ID, ": ", err)
+				break
+			}
+			if err != nil {
+				log.Warn("Cannot export trip ", t.ID, ": ", err)
+				continue
+			}
+			log.Info("Exported trip ", t.ID, " (", len(tracks), " GPS files) to ", path)
+		}
+	}
+
+}
+
+// tripTrackHandler serves a trip as gpx, geojson or kml: GET /api/trips/:id/:format
+func tripTrackHandler(c echo.Context) error {
+	format, ok := trackFormats[c.Param("format")]
+	if !ok {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "format must be gpx, geojson or kml"})
+	}
+	id := c.Param("id")
+	t, found := fileCatalog.getTrip(id)
+	if !found {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "no trip " + id})
+	}
+	data, err := format.encode("Trip "+id, loadTracks(t.gpsRecords()), t.Clips)
+	if errors.Is(err, ErrNoFixes) {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": err.Error()})
+	}
+	if err != nil {
+		return err
+	}
+	c.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("inline; filename=%q", id+format.ext))
+	return c.Blob(http.StatusOK, format.contentType, data)
+}
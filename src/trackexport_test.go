@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testTrack drives due north at 36 km/h for the given number of seconds
+func testTrack(name string, video string, from time.Time, seconds int) track {
+	t := track{Name: name, Video: video}
+	for i := 0; i <= seconds; i++ {
+		t.Points = append(t.Points, trackPoint{
+			Time:  from.Add(time.Duration(i) * time.Second),
+			Lat:   52 + float64(i)*10/111194.9, // 10m per second
+			Lon:   4,
+			Speed: 36,
+		})
+	}
+	return t
+}
+
+func TestComputeTrackStats(t *testing.T) {
+	from := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	tracks := []track{
+		testTrack("a.git", "a.mp4", from, 60),
+		testTrack("b.git", "", from.Add(time.Minute), 60),
+	}
+	stats := computeTrackStats(tracks, nil)
+	if !stats.Start.Equal(from) || !stats.End.Equal(from.Add(2*time.Minute)) {
+		t.Errorf("span %v - %v", stats.Start, stats.End)
+	}
+	if math.Abs(stats.Distance-1200) > 1 || math.Abs(stats.AvgSpeed-36) > 0.1 || stats.MaxSpeed != 36 {
+		t.Errorf("distance %v, avg %v, max %v", stats.Distance, stats.AvgSpeed, stats.MaxSpeed)
+	}
+	if !reflect.DeepEqual(stats.GpsFiles, []string{"a.git", "b.git"}) {
+		t.Errorf("GPS files %v", stats.GpsFiles)
+	}
+	// Without the trip's clips the videos come from the GPS files
+	if !reflect.DeepEqual(stats.Videos, []string{"a.mp4"}) {
+		t.Errorf("videos %v", stats.Videos)
+	}
+	clips := []string{"a.mp4", "b.mp4"}
+	if stats := computeTrackStats(tracks, clips); !reflect.DeepEqual(stats.Videos, clips) {
+		t.Errorf("videos %v, want the trip clips %v", stats.Videos, clips)
+	}
+}
+
+func TestTripExportsLinkClips(t *testing.T) {
+	from := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	// GPS files listed without a parentfile
+	tracks := []track{testTrack("a.git", "", from, 30), testTrack("b.git", "", from.Add(time.Minute), 30)}
+	clips := []string{"20230601120000_0060.mp4", "20230601120100_0060.mp4"}
+
+	data, err := encodeGeoJSON("Trip", tracks, clips)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var feature geoJSONFeature
+	if err := json.Unmarshal(data, &feature); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(feature.Properties.Videos, clips) {
+		t.Errorf("GeoJSON videos %v, want %v", feature.Properties.Videos, clips)
+	}
+
+	data, err = encodeKML("Trip", tracks, clips)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc kmlDocument
+	if err := xml.Unmarshal(data, &doc); err != nil {
+		t.Fatal(err)
+	}
+	videos := ""
+	for _, d := range doc.Placemark.Data {
+		if d.Name == "videos" {
+			videos = d.Value
+		}
+	}
+	if videos != clips[0]+","+clips[1] {
+		t.Errorf("KML videos %q", videos)
+	}
+
+	data, err = encodeGPX("Trip", tracks, clips)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var gpx struct {
+		Desc string `xml:"trk>desc"`
+	}
+	if err := xml.Unmarshal(data, &gpx); err != nil {
+		t.Fatal(err)
+	}
+	if gpx.Desc != clips[0]+", "+clips[1] {
+		t.Errorf("GPX description %q", gpx.Desc)
+	}
+}
+
+func TestTrackExportsAltitude(t *testing.T) {
+	from := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	tr := testTrack("a.git", "a.mp4", from, 2)
+	tr.Points[1].Altitude, tr.Points[1].HasAltitude = 12.5, true
+	tracks := []track{tr}
+
+	data, err := encodeGeoJSON("trip", tracks, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var feature geoJSONFeature
+	if err := json.Unmarshal(data, &feature); err != nil {
+		t.Fatal(err)
+	}
+	for i, position := range feature.Geometry.Coordinates {
+		want := 2
+		if i == 1 {
+			want = 3
+		}
+		if len(position) != want {
+			t.Errorf("GeoJSON position %d: %v, want %d values", i, position, want)
+		}
+	}
+	if feature.Geometry.Coordinates[1][2] != 12.5 {
+		t.Errorf("altitude %v, want 12.5", feature.Geometry.Coordinates[1][2])
+	}
+
+	// KML writes altitudes only when every fix has one
+	kmlCoordinates := func(tracks []track) []string {
+		data, err := encodeKML("trip", tracks, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var doc kmlDocument
+		if err := xml.Unmarshal(data, &doc); err != nil {
+			t.Fatal(err)
+		}
+		return strings.Fields(doc.Placemark.LineString.Coordinates)
+	}
+	for _, tuple := range kmlCoordinates(tracks) {
+		if strings.Count(tuple, ",") != 1 {
+			t.Errorf("KML tuple %q, want lon,lat", tuple)
+		}
+	}
+	for i := range tr.Points {
+		tr.Points[i].HasAltitude = true
+	}
+	for _, tuple := range kmlCoordinates([]track{tr}) {
+		if strings.Count(tuple, ",") != 2 {
+			t.Errorf("KML tuple %q, want lon,lat,altitude", tuple)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	log "github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Bucket holding one JSON trip per trip ID
+var tripsBucket = []byte("trips")
+
+// trip is one drive: continuous recordings and GPS files less than TRIP_GAP apart
+type trip struct {
+	ID       string    `json:"id"`
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Duration float64   `json:"duration"` // Seconds
+	Distance float64   `json:"distance"` // Meters, from the GPS files on disk when the trip last changed
+	Clips    []string  `json:"clips"`    // Recordings, oldest first
+	GpsFiles []string  `json:"gpsFiles"` // Oldest first
+}
+
+// tripID names a trip after the camera time it starts at
+func tripID(start time.Time) string {
+	return start.In(cameraTZ).Format("20060102150405")
+}
+
+// detectTrips groups the downloaded continuous recordings and GPS files into trips.
+// Records must be sorted by camera time, as catalog.list returns them.
+func detectTrips(records []fileRecord, gap time.Duration) (trips []trip) {
+	var current *trip
+	for _, record := range records {
+		isClip := record.Kind == kindRecording && record.category() == categoryContinuous
+		if !record.downloaded() || (!isClip && record.Kind != kindGPS) {
+			continue
+		}
+		start, end := record.clipSpan()
+		if current == nil || start.Sub(current.End) > gap {
+			trips = append(trips, trip{ID: tripID(start), Start: start, End: end, Clips: []string{}, GpsFiles: []string{}})
+			current = &trips[len(trips)-1]
+		}
+		if end.After(current.End) {
+			current.End = end
+		}
+		if isClip {
+			current.Clips = append(current.Clips, record.Name)
+		} else {
+			current.GpsFiles = append(current.GpsFiles, record.Name)
+		}
+	}
+	for i := range trips {
+		trips[i].Duration = trips[i].End.Sub(trips[i].Start).Seconds()
+	}
+	return trips
+}
+
+// gpsRecords returns the catalog records of the trip's GPS files that are still on disk
+func (t trip) gpsRecords() (records []fileRecord) {
+	for _, name := range t.GpsFiles {
+		if record, found := fileCatalog.get(name); found && record.stored() {
+			records = append(records, record)
+		}
+	}
+	return records
+}
+
+func sameNames(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// rebuildTrips detects the trips from the catalog records and stores them in place of
+// the previous ones. Returns the trips that are new or got different files.
+func (c *catalog) rebuildTrips(gap time.Duration) (changed []trip) {
+	previous := map[string]trip{}
+	for _, t := range c.listTrips() {
+		previous[t.ID] = t
+	}
+	trips := detectTrips(c.list(), gap)
+	for i, t := range trips {
+		if old, found := previous[t.ID]; found && sameNames(old.Clips, t.Clips) && sameNames(old.GpsFiles, t.GpsFiles) {
+			trips[i].Distance = old.Distance
+		} else {
+			trips[i].Distance = computeTrackStats(loadTracks(t.gpsRecords()), nil).Distance
+			changed = append(changed, trips[i])
+		}
+		delete(previous, t.ID)
+	}
+
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(tripsBucket)
+		for id := range previous {
+			if err := bucket.Delete([]byte(id)); err != nil {
+				return err
+			}
+		}
+		for _, t := range trips {
+			data, err := json.Marshal(t)
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put([]byte(t.ID), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Warn("Cannot store trips: ", err)
+		return nil
+	}
+	if len(changed) > 0 || len(previous) > 0 {
+		log.Info("Trips: ", len(trips), " in total, ", len(changed), " updated, ", len(previous), " removed")
+	}
+	return changed
+}
+
+// pruneTripFiles removes the exports, stitched videos and contact sheets of trips that no longer exist.
+// A trip is renamed when an older clip joins it, and gone once retention removed its files.
+func pruneTripFiles(storagePath string) {
+	dir := filepath.Join(storagePath, "trips")
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, file := range files {
+		ext := strings.ToLower(filepath.Ext(file.Name()))
+		if _, isExport := trackFormats[strings.TrimPrefix(ext, ".")]; file.IsDir() || (!isExport && ext != ".mp4" && ext != ".jpg") {
+			continue
+		}
+		if _, found := fileCatalog.getTrip(strings.TrimSuffix(file.Name(), filepath.Ext(file.Name()))); !found {
+			log.Info("Removing ", file.Name(), " of a trip that no longer exists")
+			deleteFile(filepath.Join(dir, file.Name()))
+			if record, found := fileCatalog.get(file.Name()); found && record.Kind == kindStitched {
+				fileCatalog.remove(file.Name())
+			}
+		}
+	}
+}
+
+// listTrips returns the stored trips, oldest first
+func (c *catalog) listTrips() (trips []trip) {
+	err := c.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(tripsBucket)
+		if bucket == nil { // Catalog from before trips, opened read-only
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			var t trip
+			if err := json.Unmarshal(v, &t); err != nil {
+				log.Warn("Skipping unreadable trip ", string(k), ": ", err)
+				return nil
+			}
+			trips = append(trips, t)
+			return nil
+		})
+	})
+	if err != nil {
+		log.Warn("Cannot read trips: ", err)
+	}
+	sort.SliceStable(trips, func(i, j int) bool { return trips[i].Start.Before(trips[j].Start) })
+	return trips
+}
+
+func (c *catalog) getTrip(id string) (t trip, found bool) {
+	err := c.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(tripsBucket).Get([]byte(id))
+		if data == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(data, &t)
+	})
+	if err != nil {
+		log.Warn("Cannot read trip ", id, ": ", err)
+		return t, false
+	}
+	return t, found
+}
+
+// tripsHandler lists the trips, newest first: GET /trips
+func tripsHandler(c echo.Context) error {
+	trips := fileCatalog.listTrips()
+	sort.SliceStable(trips, func(i, j int) bool { return trips[i].Start.After(trips[j].Start) })
+	if trips == nil {
+		trips = []trip{}
+	}
+	return c.JSON(http.StatusOK, trips)
+}
+
+// printTrips writes the trips as a table, for the trips command
+func printTrips(w io.Writer, trips []trip) {
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "ID\tSTART\tDURATION\tDISTANCE\tCLIPS\tGPS FILES")
+	for _, t := range trips {
+		fmt.Fprintf(table, "%s\t%s\t%s\t%.1f km\t%d\t%d\n",
+			t.ID,
+			t.Start.In(cameraTZ).Format("2006-01-02 15:04:05"),
+			time.Duration(t.Duration*float64(time.Second)).Round(time.Second),
+			t.Distance/1000,
+			len(t.Clips),
+			len(t.GpsFiles))
+	}
+	table.Flush()
+}
@@ -0,0 +1,401 @@
+"use strict";
+
+// Single page UI: the library per day, a video player and the sync status.
+// Live updates come from the /events stream, with /status polled as a fallback.
+
+const state = {
+  days: [],
+  day: "",
+  trip: "", // Shown on the map instead of the day
+  downloads: {},
+};
+
+function el(tag, attrs, ...children) {
+  const node = document.createElement(tag);
+  for (const [key, value] of Object.entries(attrs || {})) {
+    if (key.startsWith("on")) {
+      node.addEventListener(key.slice(2), value);
+    } else if (value !== undefined && value !== null && value !== false) {
+      node.setAttribute(key, value);
+    }
+  }
+  for (const child of children.flat()) {
+    if (child !== undefined && child !== null && child !== false) {
+      node.append(child);
+    }
+  }
+  return node;
+}
+
+function formatBytes(bytes) {
+  const units = ["B", "KB", "MB", "GB", "TB"];
+  let i = 0;
+  while (bytes >= 1024 && i < units.length - 1) {
+    bytes /= 1024;
+    i++;
+  }
+  return bytes.toFixed(i === 0 ? 0 : 1) + " " + units[i];
+}
+
+function formatDuration(seconds) {
+  seconds = Math.round(seconds);
+  const h = Math.floor(seconds / 3600);
+  const m = Math.floor(seconds / 60) % 60;
+  const s = seconds % 60;
+  return (h > 0 ? h + "h " : "") + (h > 0 || m > 0 ? m + "m " : "") + s + "s";
+}
+
+function formatTime(iso) {
+  const date = new Date(iso);
+  return isNaN(date) || date.getFullYear() < 2000 ? "never" : date.toLocaleString();
+}
+
+async function getJSON(url) {
+  const resp = await fetch(url);
+  if (!resp.ok) {
+    throw new Error(url + ": " + resp.status);
+  }
+  return resp.json();
+}
+
+// Library
+
+async function loadLibrary() {
+  try {
+    state.days = await getJSON("api/library");
+  } catch (err) {
+    console.warn(err);
+    return;
+  }
+  if (!state.days.some((d) => d.day === state.day)) {
+    state.day = state.days.length ? state.days[0].day : "";
+  }
+  renderDays();
+  if (!state.trip) {
+    renderDay();
+  }
+}
+
+// route shows the day or trip in the URL hash: #2023-01-01 or #trip/20230101120000
+function route() {
+  const hash = decodeURIComponent(location.hash.slice(1));
+  if (hash.startsWith("trip/")) {
+    state.trip = hash.slice("trip/".length);
+    state.day = state.trip.replace(/^(\d{4})(\d{2})(\d{2}).*/, "$1-$2-$3");
+    renderDays();
+    renderTrip(state.trip);
+    return;
+  }
+  state.trip = "";
+  if (hash) {
+    state.day = hash;
+  }
+  renderDays();
+  renderDay();
+}
+
+function renderDays() {
+  const nav = document.getElementById("days");
+  nav.replaceChildren(...state.days.map((d) => el("a", {
+    href: "#" + d.day,
+    class: d.day === state.day ? "selected" : null,
+  }, d.day, el("br"), el("small", {},
+    d.events.length + " events · " + d.recordings.length + " clips · " + d.trips.length + " trips"))));
+}
+
+function fileCard(file) {
+  const image = file.thumbnail
+    ? el("img", { src: "api/thumbnails/" + encodeURIComponent(file.name), loading: "lazy", alt: "" })
+    : el("div", { class: "noimg" });
+  return el("button", { class: "card", type: "button", title: file.name, onclick: () => play(file.name) },
+    image,
+    el("div", { class: "meta" },
+      el("strong", {}, file.time), " ",
+      file.pinned && el("span", { class: "badge pinned" }, "pinned"),
+      file.validation === "invalid" && el("span", { class: "badge invalid" }, "invalid"),
+      file.events && file.events.length > 0 && el("span", { class: "badge event" }, "event"),
+      el("small", {}, (file.duration ? formatDuration(file.duration) + " · " : "") + formatBytes(file.size))));
+}
+
+function tripCard(trip) {
+  const start = new Date(trip.start);
+  const end = new Date(trip.end);
+  return el("div", { class: "trip" },
+    el("strong", {}, start.toLocaleTimeString() + " – " + end.toLocaleTimeString()),
+    " · " + formatDuration(trip.duration) + " · " + (trip.distance / 1000).toFixed(1) + " km · " + trip.clips.length + " clips",
+    trip.gpsFiles.length > 0 && [" · ", el("a", { href: "#trip/" + trip.id }, "Map")],
+    trip.contactSheet && el("div", {}, el("img", { src: "api/trips/" + trip.id + "/contactsheet", loading: "lazy", alt: "" })),
+    el("div", { class: "clips" }, trip.clips.map((name) =>
+      el("button", { type: "button", onclick: () => play(name) }, name.slice(8, 14).replace(/(..)(..)(..)/, "$1:$2:$3")))));
+}
+
+function renderDay() {
+  const section = document.getElementById("day");
+  const day = state.days.find((d) => d.day === state.day);
+  if (!day) {
+    section.replaceChildren(el("p", { class: "empty" }, "Nothing downloaded yet."));
+    return;
+  }
+  const newestFirst = (a, b) => (a.time < b.time ? 1 : -1);
+  section.replaceChildren(
+    el("h2", {}, day.day),
+    el("h3", {}, "Events"),
+    day.events.length
+      ? el("div", { class: "grid" }, day.events.slice().sort(newestFirst).map(fileCard))
+      : el("p", { class: "empty" }, "No events."),
+    el("h3", {}, "Trips"),
+    day.trips.length
+      ? day.trips.slice().sort((a, b) => (a.start < b.start ? 1 : -1)).map(tripCard)
+      : el("p", { class: "empty" }, "No trips."),
+    el("h3", {}, "Recordings"),
+    day.recordings.length
+      ? el("div", { class: "grid" }, day.recordings.slice().sort(newestFirst).map(fileCard))
+      : el("p", { class: "empty" }, "No recordings."));
+}
+
+// Trip map: the track with a marker per event. Clicking the track plays the clip
+// recorded there from that moment.
+
+async function renderTrip(id) {
+  const section = document.getElementById("day");
+  let settings, data;
+  try {
+    [settings, data] = await Promise.all([getJSON("api/map"), getJSON("api/trips/" + encodeURIComponent(id) + "/map")]);
+  } catch (err) {
+    section.replaceChildren(el("p", { class: "empty" }, "Cannot load trip " + id + "."));
+    return;
+  }
+  if (state.trip !== id) {
+    return; // Navigated away meanwhile
+  }
+  const trip = data.trip;
+  const points = data.points.map((p) => ({ ...p, ms: Date.parse(p.time) }));
+  const clips = data.clips.map((c) => ({ ...c, startMs: Date.parse(c.start), endMs: Date.parse(c.end) }));
+  const video = el("video", { controls: true, preload: "metadata" });
+  const caption = el("p", { class: "empty" }, points.length
+    ? "Click the track to play the recording from that point."
+    : "No GPS fixes for this trip.");
+  const mapBox = el("div", { class: "map-box" });
+  section.replaceChildren(
+    el("h2", {}, "Trip " + new Date(trip.start).toLocaleString()),
+    el("p", {}, el("a", { href: "#" + state.day }, "← " + state.day), " · " + formatDuration(trip.duration) + " · " +
+      (trip.distance / 1000).toFixed(1) + " km · " + data.events.length + " events"),
+    mapBox,
+    caption,
+    el("div", { class: "trip-video" }, video));
+
+  const map = new TileMap(mapBox, settings);
+  let position = null; // Point of the video frame shown
+  let playing = null; // Clip in the player, null for an event video
+
+  map.overlays.push((ctx) => {
+    ctx.lineWidth = 4;
+    ctx.lineJoin = ctx.lineCap = "round";
+    ctx.strokeStyle = "#1e88e5";
+    ctx.beginPath();
+    points.forEach((p, i) => {
+      const s = map.toScreen(p.lat, p.lon);
+      i === 0 ? ctx.moveTo(s.x, s.y) : ctx.lineTo(s.x, s.y);
+    });
+    ctx.stroke();
+    for (const event of data.events) {
+      const s = map.toScreen(event.lat, event.lon);
+      ctx.beginPath();
+      ctx.arc(s.x, s.y, 7, 0, 2 * Math.PI);
+      ctx.fillStyle = event.stored ? "#8e24aa" : "#bdbdbd";
+      ctx.fill();
+      ctx.lineWidth = 2;
+      ctx.strokeStyle = "#fff";
+      ctx.stroke();
+    }
+    if (position) {
+      const s = map.toScreen(position.lat, position.lon);
+      ctx.beginPath();
+      ctx.arc(s.x, s.y, 6, 0, 2 * Math.PI);
+      ctx.fillStyle = "#e53935";
+      ctx.fill();
+      ctx.lineWidth = 2;
+      ctx.strokeStyle = "#fff";
+      ctx.stroke();
+    }
+  });
+  map.fit(points.length ? points : data.events);
+
+  const seek = (ms) => {
+    const clip = clips.find((c) => c.startMs <= ms && ms < c.endMs);
+    if (!clip) {
+      caption.textContent = "No recording on disk for " + new Date(ms).toLocaleTimeString() + ".";
+      return;
+    }
+    const offset = (ms - clip.startMs) / 1000;
+    caption.textContent = clip.name + " at " + new Date(ms).toLocaleTimeString();
+    if (playing === clip) {
+      video.currentTime = offset;
+    } else {
+      playing = clip;
+      video.src = "api/files/" + encodeURIComponent(clip.name);
+      video.addEventListener("loadedmetadata", () => { video.currentTime = offset; }, { once: true });
+    }
+    video.play().catch(() => {});
+  };
+
+  map.onclick = (at) => {
+    const near = (lat, lon) => {
+      const s = map.toScreen(lat, lon);
+      return Math.hypot(s.x - at.x, s.y - at.y);
+    };
+    const event = data.events.find((e) => e.stored && near(e.lat, e.lon) <= 9);
+    if (event) {
+      playing = null;
+      position = event;
+      caption.textContent = "Event " + event.name + " at " + new Date(event.time).toLocaleTimeString();
+      video.src = "api/files/" + encodeURIComponent(event.name);
+      video.play().catch(() => {});
+      map.draw();
+      return;
+    }
+    let best = null, bestDistance = 12;
+    for (const p of points) {
+      const d = near(p.lat, p.lon);
+      if (d < bestDistance) {
+        best = p;
+        bestDistance = d;
+      }
+    }
+    if (best) {
+      position = best;
+      map.draw();
+      seek(best.ms);
+    }
+  };
+
+  // Follow the video on the track, and carry on with the next clip
+  video.addEventListener("timeupdate", () => {
+    if (!playing || !points.length) {
+      return;
+    }
+    const ms = playing.startMs + video.currentTime * 1000;
+    let i = points.findIndex((p) => p.ms >= ms);
+    i = i < 0 ? points.length - 1 : i;
+    if (points[i] !== position) {
+      position = points[i];
+      map.draw();
+    }
+  });
+  video.addEventListener("ended", () => {
+    const next = playing && clips[clips.indexOf(playing) + 1];
+    if (next) {
+      seek(next.startMs);
+    }
+  });
+}
+
+// Player
+
+function play(name, seconds) {
+  const video = document.getElementById("video");
+  document.getElementById("player-title").textContent = name;
+  document.getElementById("player").hidden = false;
+  video.src = "api/files/" + encodeURIComponent(name);
+  if (seconds) {
+    video.addEventListener("loadedmetadata", () => { video.currentTime = seconds; }, { once: true });
+  }
+  video.play().catch(() => {});
+}
+
+function closePlayer() {
+  const video = document.getElementById("video");
+  video.pause();
+  video.removeAttribute("src");
+  video.load();
+  document.getElementById("player").hidden = true;
+}
+
+// Sync status
+
+async function loadStatus() {
+  let status;
+  try {
+    status = await getJSON("status");
+  } catch (err) {
+    document.getElementById("status").textContent = "Downloader unreachable";
+    return;
+  }
+  const camera = status.camera;
+  const last = status.lastSync;
+  document.getElementById("status").replaceChildren(
+    el("span", { class: "dot " + (camera.checkedAt ? (camera.reachable ? "online" : "offline") : "") }),
+    camera.reachable ? "Camera online" : "Camera offline",
+    " · " + status.phase,
+    status.currentSync && " · syncing since " + formatTime(status.currentSync.startedAt),
+    " · last sync " + (last ? formatTime(last.finishedAt) : "never"),
+    last && last.error && el("span", { class: "error", title: last.error }, " (failed)"),
+    status.skipCache.length > 0 && " · " + status.skipCache.length + " skipped");
+  state.downloads = {};
+  for (const d of status.downloads) {
+    state.downloads[d.name] = d;
+  }
+  renderDownloads();
+}
+
+function renderDownloads() {
+  const downloads = Object.values(state.downloads);
+  document.getElementById("downloads").replaceChildren(...downloads.map((d) => el("div", {},
+    el("progress", { max: 1, value: d.progress }),
+    el("span", {}, d.name),
+    el("span", {}, formatBytes(d.bytes) + " / " + formatBytes(d.size)),
+    d.bytesPerSecond > 0 && el("span", {}, formatBytes(d.bytesPerSecond) + "/s"),
+    d.eta > 0 && el("span", {}, formatDuration(d.eta) + " left"))));
+}
+
+let refreshTimer;
+
+// refreshSoon reloads the library once a burst of downloads is over
+function refreshSoon() {
+  clearTimeout(refreshTimer);
+  refreshTimer = setTimeout(loadLibrary, 3000);
+}
+
+function listen() {
+  const events = new EventSource("events");
+  events.addEventListener("download.started", (e) => {
+    const data = JSON.parse(e.data).data;
+    state.downloads[data.name] = { name: data.name, size: data.size, bytes: 0, progress: 0 };
+    renderDownloads();
+  });
+  events.addEventListener("download.progress", (e) => {
+    const data = JSON.parse(e.data).data;
+    state.downloads[data.name] = data;
+    renderDownloads();
+  });
+  for (const type of ["download.completed", "download.failed"]) {
+    events.addEventListener(type, (e) => {
+      delete state.downloads[JSON.parse(e.data).data.name];
+      renderDownloads();
+      refreshSoon();
+    });
+  }
+  events.addEventListener("file.deleted", refreshSoon);
+  for (const type of ["camera.online", "camera.offline", "list.fetched", "skipcache.added"]) {
+    events.addEventListener(type, loadStatus);
+  }
+}
+
+window.addEventListener("hashchange", route);
+document.getElementById("player-close").addEventListener("click", closePlayer);
+document.getElementById("player").addEventListener("click", (e) => {
+  if (e.target.id === "player") {
+    closePlayer();
+  }
+});
+document.addEventListener("keydown", (e) => {
+  if (e.key === "Escape") {
+    closePlayer();
+  }
+});
+
+route();
+loadLibrary();
+loadStatus();
+setInterval(loadStatus, 10000);
+listen();
@@ -0,0 +1,204 @@
+"use strict";
+
+// Small slippy map on a canvas: raster tiles, drag to pan, wheel or buttons to zoom,
+// and overlays drawn by the page. Tiles come from the URL template of /api/map, a
+// local tile server or MAP_MBTILES, so it works without internet access.
+
+const TILE_SIZE = 256;
+
+// project turns a position into world pixels at a zoom level (Web Mercator)
+function project(lat, lon, zoom) {
+  const scale = TILE_SIZE * Math.pow(2, zoom);
+  const sin = Math.min(Math.max(Math.sin(lat * Math.PI / 180), -0.9999), 0.9999);
+  return {
+    x: (lon + 180) / 360 * scale,
+    y: (0.5 - Math.log((1 + sin) / (1 - sin)) / (4 * Math.PI)) * scale,
+  };
+}
+
+class TileMap {
+  constructor(container, settings) {
+    this.settings = settings;
+    this.minZoom = settings.minZoom || 0;
+    this.maxZoom = settings.maxZoom || 19;
+    this.zoom = Math.min(Math.max(2, this.minZoom), this.maxZoom);
+    this.center = project(0, 0, this.zoom);
+    this.tiles = new Map();
+    this.overlays = [];
+    this.onclick = null;
+
+    this.element = document.createElement("div");
+    this.element.className = "map";
+    this.canvas = document.createElement("canvas");
+    this.element.append(this.canvas);
+    const zoomIn = document.createElement("button");
+    const zoomOut = document.createElement("button");
+    zoomIn.type = zoomOut.type = "button";
+    zoomIn.textContent = "+";
+    zoomOut.textContent = "−";
+    zoomIn.addEventListener("click", () => this.setZoom(this.zoom + 1));
+    zoomOut.addEventListener("click", () => this.setZoom(this.zoom - 1));
+    const controls = document.createElement("div");
+    controls.className = "map-zoom";
+    controls.append(zoomIn, zoomOut);
+    this.element.append(controls);
+    if (settings.attribution) {
+      const attribution = document.createElement("div");
+      attribution.className = "map-attribution";
+      attribution.textContent = settings.attribution;
+      this.element.append(attribution);
+    }
+    container.append(this.element);
+
+    this.listen();
+    new ResizeObserver(() => this.draw()).observe(this.canvas);
+  }
+
+  get width() { return this.canvas.clientWidth; }
+  get height() { return this.canvas.clientHeight; }
+
+  // toScreen gives the canvas position of a point, in CSS pixels
+  toScreen(lat, lon) {
+    const p = project(lat, lon, this.zoom);
+    return { x: p.x - this.center.x + this.width / 2, y: p.y - this.center.y + this.height / 2 };
+  }
+
+  // fit shows all the points at the highest zoom they fit in
+  fit(points) {
+    if (!points.length) {
+      return;
+    }
+    const lats = points.map((p) => p.lat);
+    const lons = points.map((p) => p.lon);
+    const north = Math.max(...lats), south = Math.min(...lats);
+    const east = Math.max(...lons), west = Math.min(...lons);
+    const padding = 40;
+    let zoom = this.maxZoom;
+    for (; zoom > this.minZoom; zoom--) {
+      const ne = project(north, east, zoom);
+      const sw = project(south, west, zoom);
+      if (ne.x - sw.x <= this.width - 2 * padding && sw.y - ne.y <= this.height - 2 * padding) {
+        break;
+      }
+    }
+    this.zoom = Math.min(zoom, 17);
+    const ne = project(north, east, this.zoom);
+    const sw = project(south, west, this.zoom);
+    this.center = { x: (ne.x + sw.x) / 2, y: (ne.y + sw.y) / 2 };
+    this.draw();
+  }
+
+  // setZoom zooms keeping the world point under the anchor (canvas CSS pixels) in place
+  setZoom(zoom, anchor) {
+    zoom = Math.min(Math.max(zoom, this.minZoom), this.maxZoom);
+    if (zoom === this.zoom) {
+      return;
+    }
+    anchor = anchor || { x: this.width / 2, y: this.height / 2 };
+    const factor = Math.pow(2, zoom - this.zoom);
+    const worldX = this.center.x + anchor.x - this.width / 2;
+    const worldY = this.center.y + anchor.y - this.height / 2;
+    this.center = {
+      x: worldX * factor - anchor.x + this.width / 2,
+      y: worldY * factor - anchor.y + this.height / 2,
+    };
+    this.zoom = zoom;
+    this.draw();
+  }
+
+  listen() {
+    let drag = null;
+    this.canvas.addEventListener("pointerdown", (e) => {
+      drag = { x: e.clientX, y: e.clientY, moved: 0 };
+      this.canvas.setPointerCapture(e.pointerId);
+    });
+    this.canvas.addEventListener("pointermove", (e) => {
+      if (!drag) {
+        return;
+      }
+      const dx = e.clientX - drag.x, dy = e.clientY - drag.y;
+      drag.moved += Math.abs(dx) + Math.abs(dy);
+      drag.x = e.clientX;
+      drag.y = e.clientY;
+      this.center = { x: this.center.x - dx, y: this.center.y - dy };
+      this.draw();
+    });
+    this.canvas.addEventListener("pointerup", (e) => {
+      // Barely moving counts as a click
+      if (drag && drag.moved < 5 && this.onclick) {
+        const rect = this.canvas.getBoundingClientRect();
+        this.onclick({ x: e.clientX - rect.left, y: e.clientY - rect.top });
+      }
+      drag = null;
+    });
+    this.canvas.addEventListener("wheel", (e) => {
+      e.preventDefault();
+      const rect = this.canvas.getBoundingClientRect();
+      this.setZoom(this.zoom + (e.deltaY < 0 ? 1 : -1), { x: e.clientX - rect.left, y: e.clientY - rect.top });
+    }, { passive: false });
+  }
+
+  tile(z, x, y) {
+    const key = z + "/" + x + "/" + y;
+    let image = this.tiles.get(key);
+    if (!image) {
+      image = new Image();
+      image.addEventListener("load", () => this.draw());
+      image.src = this.settings.tiles.replace("{z}", z).replace("{x}", x).replace("{y}", y);
+      this.tiles.set(key, image);
+      // Keep the cache to a few screens worth of tiles
+      if (this.tiles.size > 500) {
+        this.tiles.delete(this.tiles.keys().next().value);
+      }
+    }
+    return image;
+  }
+
+  // draw repaints on the next frame; calls in between are merged
+  draw() {
+    if (this.pending) {
+      return;
+    }
+    this.pending = requestAnimationFrame(() => {
+      this.pending = null;
+      this.paint();
+    });
+  }
+
+  paint() {
+    const ratio = window.devicePixelRatio || 1;
+    const width = this.width, height = this.height;
+    if (this.canvas.width !== Math.round(width * ratio) || this.canvas.height !== Math.round(height * ratio)) {
+      this.canvas.width = Math.round(width * ratio);
+      this.canvas.height = Math.round(height * ratio);
+    }
+    const ctx = this.canvas.getContext("2d");
+    ctx.setTransform(ratio, 0, 0, ratio, 0, 0);
+    ctx.fillStyle = "#e0e0e0";
+    ctx.fillRect(0, 0, width, height);
+
+    if (this.settings.tiles) {
+      const count = Math.pow(2, this.zoom);
+      const left = this.center.x - width / 2, top = this.center.y - height / 2;
+      const firstX = Math.floor(left / TILE_SIZE), lastX = Math.floor((left + width) / TILE_SIZE);
+      const firstY = Math.max(0, Math.floor(top / TILE_SIZE)), lastY = Math.min(count - 1, Math.floor((top + height) / TILE_SIZE));
+      for (let x = firstX; x <= lastX; x++) {
+        for (let y = firstY; y <= lastY; y++) {
+          const image = this.tile(this.zoom, ((x % count) + count) % count, y);
+          if (image.complete && image.naturalWidth) {
+            ctx.drawImage(image, Math.round(x * TILE_SIZE - left), Math.round(y * TILE_SIZE - top), TILE_SIZE, TILE_SIZE);
+          }
+        }
+      }
+    } else {
+      ctx.fillStyle = "#777";
+      ctx.font = "13px system-ui, sans-serif";
+      ctx.fillText("No map tiles configured (MAP_TILE_URL or MAP_MBTILES)", 10, height - 10);
+    }
+    for (const overlay of this.overlays) {
+      ctx.save();
+      overlay(ctx, this);
+      ctx.restore();
+    }
+  }
+}
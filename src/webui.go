@@ -0,0 +1,103 @@
+package main
+
+import (
+	"embed"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// The single page UI, served from / with no external assets
+//
+//go:embed web
+var webFiles embed.FS
+
+// libraryFile is a downloaded video as the UI lists it
+type libraryFile struct {
+	Name       string   `json:"name"`
+	Category   category `json:"category"`
+	Time       string   `json:"time"` // Camera time of day
+	Duration   float64  `json:"duration,omitempty"`
+	Size       int64    `json:"size"`
+	Pinned     bool     `json:"pinned,omitempty"`
+	Validation string   `json:"validation,omitempty"`
+	Thumbnail  bool     `json:"thumbnail"`
+	Events     []string `json:"events,omitempty"`
+}
+
+type libraryTrip struct {
+	trip
+	ContactSheet bool `json:"contactSheet"`
+}
+
+// libraryDay holds what was recorded on one camera day
+type libraryDay struct {
+	Day        string        `json:"day"`
+	Events     []libraryFile `json:"events"`
+	Recordings []libraryFile `json:"recordings"`
+	Trips      []libraryTrip `json:"trips"`
+}
+
+// library groups the stored videos and the trips per camera day, newest day first
+func library() []libraryDay {
+	days := map[string]*libraryDay{}
+	day := func(key string) *libraryDay {
+		if days[key] == nil {
+			days[key] = &libraryDay{Day: key, Events: []libraryFile{}, Recordings: []libraryFile{}, Trips: []libraryTrip{}}
+		}
+		return days[key]
+	}
+
+	records := fileCatalog.list()
+	thumbnails := map[string]bool{}
+	for _, record := range records {
+		if record.Kind == kindThumbnail && record.stored() {
+			thumbnails[record.Name] = true
+		}
+	}
+	for _, record := range records {
+		if !record.stored() || (record.Kind != kindEvent && record.Kind != kindRecording) {
+			continue
+		}
+		local := record.CameraTime.In(cameraTZ)
+		file := libraryFile{
+			Name:       record.Name,
+			Category:   record.category(),
+			Time:       local.Format("15:04:05"),
+			Duration:   record.Duration,
+			Size:       record.Size,
+			Pinned:     record.Pinned,
+			Validation: record.Validation,
+			Thumbnail:  record.Thumbnail != "",
+			Events:     record.Events,
+		}
+		d := day(local.Format("2006-01-02"))
+		if record.Kind == kindEvent {
+			file.Thumbnail = thumbnails[strings.TrimSuffix(record.Name, filepath.Ext(record.Name))+".jpg"]
+			d.Events = append(d.Events, file)
+		} else {
+			d.Recordings = append(d.Recordings, file)
+		}
+	}
+	for _, t := range fileCatalog.listTrips() {
+		_, err := os.Stat(contactSheetPathFor(t))
+		d := day(t.Start.In(cameraTZ).Format("2006-01-02"))
+		d.Trips = append(d.Trips, libraryTrip{trip: t, ContactSheet: err == nil})
+	}
+
+	list := make([]libraryDay, 0, len(days))
+	for _, d := range days {
+		list = append(list, *d)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Day > list[j].Day })
+	return list
+}
+
+// libraryHandler lists the downloaded events, recordings and trips per day: GET /api/library
+func libraryHandler(c echo.Context) error {
+	return c.JSON(http.StatusOK, library())
+}